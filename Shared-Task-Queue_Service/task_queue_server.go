@@ -2,8 +2,13 @@ package main
 
 import (
 	"bufio"
+	"container/heap"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,44 +16,503 @@ import (
 
 // struct each that will be submitted or take with id
 type Task struct {
-	ID      int
-	Content string
+	ID       int
+	Content  string
+	Queue    string
+	Priority int
+	Attempts int       // how many times the task was handed out by NEXT
+	RunAt    time.Time // zero for tasks that are ready right away
+
+	waitingSince time.Time // when the task got into its current priority level, used for aging
+}
+
+// priority levels, NEXT always takes from the highest level that has tasks
+const (
+	PriorityLow = iota
+	PriorityNormal
+	PriorityHigh
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"low", "normal", "high"}
+
+func parsePriority(name string) (int, bool) {
+	for p, n := range priorityNames {
+		if n == name {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// one FIFO slice per priority level, so tasks with the same priority keep their order
+type priorityQueue struct {
+	levels [numPriorities][]Task
+}
+
+// add the task at the end of its level
+func (pq *priorityQueue) push(task Task) {
+	pq.levels[task.Priority] = append(pq.levels[task.Priority], task)
+}
+
+// put the task back at the start of its level, used for NACK and expired leases
+func (pq *priorityQueue) pushFront(task Task) {
+	pq.levels[task.Priority] = append([]Task{task}, pq.levels[task.Priority]...)
+}
+
+// take the first task of the highest priority level
+func (pq *priorityQueue) pop() (Task, bool) {
+	for p := numPriorities - 1; p >= 0; p-- {
+		if len(pq.levels[p]) > 0 {
+			task := pq.levels[p][0]
+			pq.levels[p] = pq.levels[p][1:]
+			return task, true
+		}
+	}
+	return Task{}, false
+}
+
+func (pq *priorityQueue) len() int {
+	n := 0
+	for _, level := range pq.levels {
+		n += len(level)
+	}
+	return n
+}
+
+// move the tasks that waited longer than after in their level one level up,
+// so a steady stream of high priority tasks can't starve the low ones forever
+func (pq *priorityQueue) age(now time.Time, after time.Duration) {
+	// go from the top so a task is promoted only one level per check
+	for p := numPriorities - 2; p >= 0; p-- {
+		// redelivered tasks go to the front with their old waiting time, so the
+		// level isn't sorted by it and the whole level has to be checked
+		var kept []Task
+		for _, task := range pq.levels[p] {
+			if now.Sub(task.waitingSince) < after {
+				kept = append(kept, task)
+				continue
+			}
+			task.Priority = p + 1
+			task.waitingSince = now
+			pq.push(task)
+		}
+		pq.levels[p] = kept
+	}
+}
+
+// delayed tasks ordered by the time they become due, the first one is the next due
+type taskHeap []Task
+
+func (h taskHeap) Len() int { return len(h) }
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].RunAt.Equal(h[j].RunAt) {
+		return h[i].ID < h[j].ID
+	}
+	return h[i].RunAt.Before(h[j].RunAt)
+}
+func (h taskHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *taskHeap) Push(x interface{}) { *h = append(*h, x.(Task)) }
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	task := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return task
+}
+
+// a parsed five field cron expression: minute hour day-of-month month day-of-week.
+// every field is a bit set of the values it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// like classic cron, when both day fields are restricted a day matching either one fires
+	domAny, dowAny bool
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parse a standard cron expression like "0 2 * * *" or "*/15 9-17 * * mon-fri"
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(strings.ToLower(spec))
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression needs 5 fields: minute hour day month weekday")
+	}
+	var sched cronSchedule
+	var err error
+	if sched.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if sched.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if sched.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if sched.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	// 7 is sunday too
+	if sched.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+	sched.domAny = strings.HasPrefix(fields[2], "*")
+	sched.dowAny = strings.HasPrefix(fields[4], "*")
+	return &sched, nil
+}
+
+// parse a comma separated list of *, n, a-b with an optional /step.
+// names are counted from min, so "jan" is 1 and "sun" is 0
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if s == name {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "5/15" means from 5 to the end every 15
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %q goes backwards", rng)
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// the first time after t the schedule fires, in the location loc.
+// zero when it never fires, like "0 0 30 2 *".
+// the schedule is matched against the wall clock of loc. a time skipped when
+// DST starts runs when the clock jumps, at the end of the gap, and a time
+// repeated when DST ends runs once, at its first occurrence. jobs that run
+// every hour follow the real hours instead: nothing runs in the gap and the
+// repeated hour runs twice
+func (c *cronSchedule) next(t time.Time, loc *time.Location) time.Time {
+	hourly := c.hour == 1<<24-1
+	// walk the wall clock in UTC, where every day has 24 hours. start a few
+	// hours back so the second pass of a repeated hour is not skipped
+	wall := t.In(loc)
+	w := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute()+1, 0, 0, time.UTC).Add(-3 * time.Hour)
+	// every date repeats its weekday within 28 years, so give up after that
+	limit := w.AddDate(28, 0, 0)
+	for w.Before(limit) {
+		switch {
+		case c.month&(1<<uint(w.Month())) == 0:
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchDay(w):
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(w.Hour())) == 0:
+			w = time.Date(w.Year(), w.Month(), w.Day(), w.Hour()+1, 0, 0, 0, time.UTC)
+		case c.minute&(1<<uint(w.Minute())) == 0:
+			w = w.Add(time.Minute)
+		default:
+			instants, gap := wallInstants(w, loc)
+			switch {
+			case gap && hourly:
+				instants = nil
+			case !hourly:
+				instants = instants[:1]
+			}
+			for _, at := range instants {
+				if at.After(t) {
+					return at
+				}
+			}
+			w = w.Add(time.Minute)
+		}
+	}
+	return time.Time{}
 }
 
+// the instants whose wall clock in loc reads w, given in UTC. there is one most of
+// the time and two in the hour repeated when DST ends. w in the gap skipped when
+// DST starts has none, then the end of the gap is returned with gap set
+func wallInstants(w time.Time, loc *time.Location) (instants []time.Time, gap bool) {
+	guess := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, 0, loc)
+	// the offset of the guess and of the zones before and after it
+	_, offset := guess.Zone()
+	offsets := []int{offset}
+	start, end := guess.ZoneBounds()
+	if !start.IsZero() {
+		_, before := start.Add(-time.Second).Zone()
+		offsets = append(offsets, before)
+	}
+	if !end.IsZero() {
+		_, after := end.Zone()
+		offsets = append(offsets, after)
+	}
+
+	var latest time.Time
+	for _, offset := range offsets {
+		at := w.Add(-time.Duration(offset) * time.Second).In(loc)
+		if at.After(latest) {
+			latest = at
+		}
+		if at.Hour() != w.Hour() || at.Minute() != w.Minute() || at.Day() != w.Day() {
+			continue
+		}
+		known := false
+		for _, other := range instants {
+			known = known || other.Equal(at)
+		}
+		if !known {
+			instants = append(instants, at)
+		}
+	}
+	if len(instants) == 0 {
+		// the latest candidate is already past the jump, its zone starts with it
+		gapEnd, _ := latest.ZoneBounds()
+		return []time.Time{gapEnd}, true
+	}
+	sort.Slice(instants, func(i, j int) bool { return instants[i].Before(instants[j]) })
+	return instants, false
+}
+
+// a recurring task, its content is enqueued every time the schedule fires
+type cronJob struct {
+	Name string
+	Spec string
+	Task Task // queue, priority and content of the tasks it enqueues
+	Next time.Time
+
+	sched *cronSchedule
+}
+
+// what to do with runs that were missed, for example because the machine slept
+const (
+	CatchUpSkip = "skip" // drop missed runs, wait for the next one
+	CatchUpOnce = "once" // enqueue one task for all the missed runs
+	CatchUpAll  = "all"  // enqueue a task for every missed run, up to maxCatchUp
+)
+
+// a run counts as missed when it is this late
+const cronGrace = time.Minute
+
+// at most this many missed runs of one job are enqueued with the "all" policy
+const maxCatchUp = 100
+
+// move Next past now and return how many tasks to enqueue for the runs that
+// were due. runs late by more than cronGrace were missed and follow the catch
+// up policy
+func (job *cronJob) dueRuns(now time.Time, loc *time.Location, catchUp string) int {
+	onTime, missed := 0, 0
+	for !job.Next.IsZero() && !job.Next.After(now) {
+		if now.Sub(job.Next) < cronGrace {
+			onTime++
+		} else {
+			missed++
+		}
+		job.Next = job.sched.next(job.Next, loc)
+		// after a long sleep don't walk every missed minute
+		if missed > maxCatchUp {
+			job.Next = job.sched.next(now, loc)
+		}
+	}
+	runs := onTime
+	if missed > 0 {
+		switch catchUp {
+		case CatchUpOnce:
+			runs++
+		case CatchUpAll:
+			runs += missed
+		}
+		fmt.Printf("Cron %s missed %d runs, catch up policy %s\n", job.Name, missed, catchUp)
+	}
+	if runs > maxCatchUp {
+		runs = maxCatchUp
+	}
+	return runs
+}
+
+// a task handed out by NEXT stays here until it is acknowledged,
+// if the lease runs out the task goes back to its queue
+type lease struct {
+	task     Task
+	owner    string // address of the client that got the task
+	deadline time.Time
+}
+
+// settings every named queue carries, new queues start with the server defaults
+type QueueSettings struct {
+	MaxLen    int           // most tasks waiting in the queue, 0 means no limit
+	LeaseTime time.Duration // how long a worker has to ACK a task before it is redelivered
+}
+
+// a named queue, created the first time a task or a setting is sent to it
+type namedQueue struct {
+	tasks     priorityQueue
+	scheduled int // delayed tasks of this queue waiting in the timer heap
+	settings  QueueSettings
+}
+
+// queue used when a command doesn't name one
+const defaultQueue = "default"
+
+// queue names are lowercased like the rest of the message, keep them to simple words
+func validQueueName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// how often the stateful goroutine looks for expired leases and tasks to age
+const tickInterval = 500 * time.Millisecond
+
 // struct that contain task struct and also a response channel
 // to verify whether the task submitted successfully or not
 // think of it as carrier
 type SubmitOp struct {
 	task   Task
-	respCh chan bool
+	respCh chan error
 }
 
 // struct same as SubmitOp this will send the task to the client
-// using a dedicated response channel
+// using a dedicated response channel. the task is leased to owner
 type NextOp struct {
+	queue  string
+	owner  string
 	respCh chan *Task
 }
 
-// helps to check how many tasks left in the queue
+// ACK, NACK or EXTEND of a leased task, only the client holding the lease can do it
+type LeaseOp struct {
+	action string // "ack", "nack" or "extend"
+	id     int
+	owner  string
+	respCh chan LeaseResult
+}
+
+type LeaseResult struct {
+	Err       error
+	LeaseTime time.Duration // lease time of the task's queue, for EXTEND
+}
+
+// helps to check how many tasks left in a queue and how many are leased
 type StatusOp struct {
-	respCh chan int
+	queue  string
+	respCh chan Status
+}
+
+type Status struct {
+	Queue      string
+	Ready      int
+	ByPriority [numPriorities]int
+	Leased     int
+	Scheduled  int
+	Settings   QueueSettings
+}
+
+// lists every queue with its depth, sorted by name
+type QueuesOp struct {
+	respCh chan []Status
+}
+
+// reads or changes the settings of a queue, nil fields are left as they are
+type ConfigOp struct {
+	queue     string
+	maxLen    *int
+	leaseTime *time.Duration
+	respCh    chan QueueSettings
+}
+
+// CRON ADD, CRON DEL or CRON LIST of the recurring tasks
+type CronOp struct {
+	action string // "add", "del" or "list"
+	job    cronJob
+	respCh chan CronResult
+}
+
+type CronResult struct {
+	Err  error
+	Jobs []cronJob // the added job for "add", every job sorted by name for "list"
 }
 
-// server which governs submit and take tasks from the queue
+// server which governs submit and take tasks from the queues
 // and with waitgroup to help track of the clients
 type TaskQueueServer struct {
 	submitCh chan SubmitOp
 	nextCh   chan NextOp
+	leaseCh  chan LeaseOp
 	statusCh chan StatusOp
+	queuesCh chan QueuesOp
+	configCh chan ConfigOp
+	cronCh   chan CronOp
 	client   sync.WaitGroup
+
+	defaults QueueSettings  // settings of a queue when it is created
+	aging    time.Duration  // how long a task waits before moving one priority up, 0 turns aging off
+	cronLoc  *time.Location // timezone the cron expressions are evaluated in
+	catchUp  string         // CatchUpSkip, CatchUpOnce or CatchUpAll
 }
 
 // Initilize the structs
-func NewTaskQueueServer() *TaskQueueServer {
+func NewTaskQueueServer(defaults QueueSettings, aging time.Duration, cronLoc *time.Location, catchUp string) *TaskQueueServer {
 	return &TaskQueueServer{
 		submitCh: make(chan SubmitOp),
 		nextCh:   make(chan NextOp),
+		leaseCh:  make(chan LeaseOp),
 		statusCh: make(chan StatusOp),
+		queuesCh: make(chan QueuesOp),
+		configCh: make(chan ConfigOp),
+		cronCh:   make(chan CronOp),
+		defaults: defaults,
+		aging:    aging,
+		cronLoc:  cronLoc,
+		catchUp:  catchUp,
 	}
 }
 
@@ -67,36 +531,7 @@ func (tqs *TaskQueueServer) Run() {
 
 	// used goroutine here to not block accepting new clients
 	// and to apply stateful goroutine concept
-	go func() {
-		// queue where the tasks will be stored
-		var queue []Task
-		// helps to track the id of tasks
-		var taskId int
-		for {
-			// used select here to listen to incoming requests
-			select {
-			case submit := <-tqs.submitCh:
-				// increase when new task submitted
-				taskId++
-				submit.task.ID = taskId
-				queue = append(queue, submit.task)
-				// send signal that the task is stored successfully
-				submit.respCh <- true
-			case next := <-tqs.nextCh:
-				// return the first task as FIRST IN LAST OUT operation
-				if len(queue) == 0 {
-					next.respCh <- nil
-				} else {
-					task := queue[0]
-					next.respCh <- &task
-					queue = queue[1:]
-				}
-			case status := <-tqs.statusCh:
-				// returns number of tasks left using channel
-				status.respCh <- len(queue)
-			}
-		}
-	}()
+	go tqs.manageQueue()
 
 	for {
 		// accept new clients
@@ -113,12 +548,241 @@ func (tqs *TaskQueueServer) Run() {
 	}
 }
 
+// the stateful goroutine, the only one touching the queues and the leases
+func (tqs *TaskQueueServer) manageQueue() {
+	// named queues where the tasks will be stored, each ordered by priority
+	queues := make(map[string]*namedQueue)
+	// tasks handed out by NEXT and not acknowledged yet, from every queue
+	leases := make(map[int]*lease)
+	// delayed tasks of every queue, moved to their queue when they are due
+	var delayed taskHeap
+	// fires when the first delayed task is due, nil while there are none
+	var dueTimer *time.Timer
+	var dueCh <-chan time.Time
+	// recurring tasks by name
+	cronJobs := make(map[string]*cronJob)
+	// helps to track the id of tasks, ids are unique over all queues so ACK only needs the id
+	var taskId int
+
+	// queues are created lazily the first time they are used
+	getQueue := func(name string) *namedQueue {
+		q, ok := queues[name]
+		if !ok {
+			q = &namedQueue{settings: tqs.defaults}
+			queues[name] = q
+			fmt.Printf("Queue %s created\n", name)
+		}
+		return q
+	}
+	status := func(name string) Status {
+		st := Status{Queue: name, Settings: tqs.defaults}
+		if q, ok := queues[name]; ok {
+			st.Ready = q.tasks.len()
+			st.Scheduled = q.scheduled
+			st.Settings = q.settings
+			for p, level := range q.tasks.levels {
+				st.ByPriority[p] = len(level)
+			}
+		}
+		for _, l := range leases {
+			if l.task.Queue == name {
+				st.Leased++
+			}
+		}
+		return st
+	}
+
+	// point the timer to the first delayed task, a new timer every time
+	// so there is no old value left in the channel
+	armTimer := func() {
+		if dueTimer != nil {
+			dueTimer.Stop()
+			dueTimer, dueCh = nil, nil
+		}
+		if len(delayed) > 0 {
+			dueTimer = time.NewTimer(time.Until(delayed[0].RunAt))
+			dueCh = dueTimer.C
+		}
+	}
+
+	// store a new task in its queue or in the timer heap when it is delayed
+	enqueue := func(task Task) (Task, error) {
+		q := getQueue(task.Queue)
+		// delayed tasks count too, else the queue would be full the moment they are due
+		if q.settings.MaxLen > 0 && q.tasks.len()+q.scheduled >= q.settings.MaxLen {
+			return task, fmt.Errorf("queue %s is full (%d tasks)", task.Queue, q.settings.MaxLen)
+		}
+		// increase when new task submitted
+		taskId++
+		task.ID = taskId
+		if task.RunAt.After(time.Now()) {
+			heap.Push(&delayed, task)
+			q.scheduled++
+			armTimer()
+		} else {
+			task.waitingSince = time.Now()
+			q.tasks.push(task)
+		}
+		return task, nil
+	}
+
+	// enqueue the runs of a cron job that are due
+	runCron := func(job *cronJob, now time.Time) {
+		runs := job.dueRuns(now, tqs.cronLoc, tqs.catchUp)
+		for i := 0; i < runs; i++ {
+			if _, err := enqueue(job.Task); err != nil {
+				fmt.Printf("Cron %s: %v\n", job.Name, err)
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		// used select here to listen to incoming requests
+		select {
+		case submit := <-tqs.submitCh:
+			// send signal that the task is stored successfully
+			_, err := enqueue(submit.task)
+			submit.respCh <- err
+		case next := <-tqs.nextCh:
+			// return the first task of the highest priority and lease it to the client.
+			// asking an unknown queue doesn't create it
+			q, ok := queues[next.queue]
+			if !ok {
+				next.respCh <- nil
+				continue
+			}
+			if task, ok := q.tasks.pop(); !ok {
+				next.respCh <- nil
+			} else {
+				task.Attempts++
+				leases[task.ID] = &lease{task: task, owner: next.owner, deadline: time.Now().Add(q.settings.LeaseTime)}
+				next.respCh <- &task
+			}
+		case op := <-tqs.leaseCh:
+			l, ok := leases[op.id]
+			switch {
+			case !ok:
+				op.respCh <- LeaseResult{Err: fmt.Errorf("task %d is not leased", op.id)}
+			case l.owner != op.owner:
+				op.respCh <- LeaseResult{Err: fmt.Errorf("task %d is leased by another client", op.id)}
+			case op.action == "ack":
+				delete(leases, op.id)
+				op.respCh <- LeaseResult{}
+			case op.action == "nack":
+				// released tasks go first so they are retried right away
+				// it keeps its waiting time, a task NACKed over and over still ages
+				delete(leases, op.id)
+				getQueue(l.task.Queue).tasks.pushFront(l.task)
+				op.respCh <- LeaseResult{}
+			case op.action == "extend":
+				leaseTime := getQueue(l.task.Queue).settings.LeaseTime
+				l.deadline = time.Now().Add(leaseTime)
+				op.respCh <- LeaseResult{LeaseTime: leaseTime}
+			default:
+				op.respCh <- LeaseResult{Err: errors.New("unknown lease action")}
+			}
+		case now := <-dueCh:
+			// move every due task to the end of its queue, in the order they were due
+			for len(delayed) > 0 && !delayed[0].RunAt.After(now) {
+				task := heap.Pop(&delayed).(Task)
+				q := getQueue(task.Queue)
+				q.scheduled--
+				task.waitingSince = now
+				q.tasks.push(task)
+			}
+			armTimer()
+		case now := <-ticker.C:
+			// redeliver the tasks whose worker didn't ACK in time, oldest task first
+			var expired []Task
+			for id, l := range leases {
+				if now.After(l.deadline) {
+					expired = append(expired, l.task)
+					delete(leases, id)
+				}
+			}
+			// pushing to the front in reverse keeps the oldest task first
+			sort.Slice(expired, func(i, j int) bool { return expired[i].ID > expired[j].ID })
+			for _, task := range expired {
+				fmt.Printf("Lease of task %d expired, redelivering it\n", task.ID)
+				// redelivered tasks don't count against the max length, they were accepted already
+				getQueue(task.Queue).tasks.pushFront(task)
+			}
+			for _, job := range cronJobs {
+				runCron(job, now)
+			}
+			if tqs.aging > 0 {
+				for _, q := range queues {
+					q.tasks.age(now, tqs.aging)
+				}
+			}
+		case op := <-tqs.statusCh:
+			// returns number of tasks left using channel
+			op.respCh <- status(op.queue)
+		case op := <-tqs.queuesCh:
+			list := make([]Status, 0, len(queues))
+			for name := range queues {
+				list = append(list, status(name))
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].Queue < list[j].Queue })
+			op.respCh <- list
+		case op := <-tqs.configCh:
+			// only showing the settings doesn't create the queue, like STATUS,
+			// so a mistyped name doesn't leave an empty queue behind
+			if op.maxLen == nil && op.leaseTime == nil {
+				op.respCh <- status(op.queue).Settings
+				continue
+			}
+			q := getQueue(op.queue)
+			if op.maxLen != nil {
+				q.settings.MaxLen = *op.maxLen
+			}
+			if op.leaseTime != nil {
+				q.settings.LeaseTime = *op.leaseTime
+			}
+			op.respCh <- q.settings
+		case op := <-tqs.cronCh:
+			switch op.action {
+			case "add":
+				if _, ok := cronJobs[op.job.Name]; ok {
+					op.respCh <- CronResult{Err: fmt.Errorf("cron %s already exists, CRON DEL it first", op.job.Name)}
+					continue
+				}
+				job := op.job
+				job.Next = job.sched.next(time.Now(), tqs.cronLoc)
+				if job.Next.IsZero() {
+					op.respCh <- CronResult{Err: fmt.Errorf("%q never fires", job.Spec)}
+					continue
+				}
+				cronJobs[job.Name] = &job
+				op.respCh <- CronResult{Jobs: []cronJob{job}}
+			case "del":
+				if _, ok := cronJobs[op.job.Name]; !ok {
+					op.respCh <- CronResult{Err: fmt.Errorf("no cron named %s", op.job.Name)}
+					continue
+				}
+				delete(cronJobs, op.job.Name)
+				op.respCh <- CronResult{}
+			case "list":
+				var list []cronJob
+				for _, job := range cronJobs {
+					list = append(list, *job)
+				}
+				sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+				op.respCh <- CronResult{Jobs: list}
+			}
+		}
+	}
+}
+
 func (tqs *TaskQueueServer) handleClient(conn net.Conn) {
 	defer conn.Close()
 	defer tqs.client.Done()
 
 	reader := bufio.NewReader(conn)
-	fmt.Fprintf(conn, "Welcome to Task Queue!\nAdd Task (Task: <task>) or get (NEXT), Status (status), 'exit' to quit:\n")
+	fmt.Fprintf(conn, "Welcome to Task Queue!\nAdd Task (Task [queue] [AT <time>|IN <duration>]: <task>) or get (NEXT [queue]), then ACK <id>, NACK <id> or EXTEND <id>, Status (status [queue]), QUEUES, CRON ADD/DEL/LIST, 'exit' to quit:\n")
 
 	for {
 		// accept client message
@@ -139,22 +803,42 @@ func (tqs *TaskQueueServer) handleClient(conn net.Conn) {
 			return
 		}
 
-		if strings.ToLower(msg) == "status" {
+		// every command is one word, mostly followed by a queue name or a task id
+		fields := strings.Fields(strings.ToLower(msg))
+		command := ""
+		if len(fields) > 0 {
+			command = fields[0]
+		}
+
+		// STATUS [queue]
+		if command == "status" && len(fields) <= 2 {
 			// prepare stat struct and send it to the stat accept channel then process it
-			stat := StatusOp{respCh: make(chan int)}
+			stat := StatusOp{queue: defaultQueue, respCh: make(chan Status)}
+			if len(fields) == 2 {
+				stat.queue = fields[1]
+			}
 			tqs.statusCh <- stat
-			task := <-stat.respCh
-			if task <= 1 {
-				fmt.Fprintf(conn, "%d Task left\n", task)
+			status := <-stat.respCh
+			// highest priority first like NEXT takes them
+			var levels []string
+			for p := numPriorities - 1; p >= 0; p-- {
+				levels = append(levels, fmt.Sprintf("%s %d", priorityNames[p], status.ByPriority[p]))
+			}
+			if status.Ready <= 1 {
+				fmt.Fprintf(conn, "%d Task left (%s), %d in progress, %d scheduled\n", status.Ready, strings.Join(levels, ", "), status.Leased, status.Scheduled)
 				continue
 			}
-			fmt.Fprintf(conn, "%d Tasks left\n", task)
+			fmt.Fprintf(conn, "%d Tasks left (%s), %d in progress, %d scheduled\n", status.Ready, strings.Join(levels, ", "), status.Leased, status.Scheduled)
 			continue
 		}
 
-		if strings.ToLower(msg) == "next" {
+		// NEXT [queue]
+		if command == "next" && len(fields) <= 2 {
 			// create a struct with inilized channel to accept the task and return to the client
-			next := NextOp{respCh: make(chan *Task)}
+			next := NextOp{queue: defaultQueue, owner: conn.RemoteAddr().String(), respCh: make(chan *Task)}
+			if len(fields) == 2 {
+				next.queue = fields[1]
+			}
 			tqs.nextCh <- next
 			task := <-next.respCh
 			if task == nil {
@@ -165,28 +849,360 @@ func (tqs *TaskQueueServer) handleClient(conn net.Conn) {
 			continue
 		}
 
-		if strings.HasPrefix(strings.ToLower(msg), "task: ") {
-			// parse the task name
-			msg = strings.TrimSpace(strings.TrimPrefix(strings.ToLower(msg), "task: "))
-			if msg == "" {
-				fmt.Fprintf(conn, "Invalid Task\n")
+		// QUEUES lists every queue with how many tasks wait in it
+		if command == "queues" && len(fields) == 1 {
+			op := QueuesOp{respCh: make(chan []Status)}
+			tqs.queuesCh <- op
+			list := <-op.respCh
+			if len(list) == 0 {
+				fmt.Fprintf(conn, "No queues yet\n")
+				continue
+			}
+			for _, st := range list {
+				fmt.Fprintf(conn, "%s: %d ready, %d in progress, %d scheduled\n", st.Queue, st.Ready, st.Leased, st.Scheduled)
+			}
+			continue
+		}
+
+		// QUEUE <name> [MAXLEN <n>] [LEASE <duration>] shows or changes the settings of a queue
+		if command == "queue" {
+			op, err := parseQueueConfig(fields[1:])
+			if err != nil {
+				fmt.Fprintf(conn, "Invalid Queue: %v\n", err)
+				continue
+			}
+			tqs.configCh <- op
+			settings := <-op.respCh
+			maxLen := "no limit"
+			if settings.MaxLen > 0 {
+				maxLen = strconv.Itoa(settings.MaxLen)
+			}
+			fmt.Fprintf(conn, "Queue %s: max length %s, lease %s\n", op.queue, maxLen, settings.LeaseTime)
+			continue
+		}
+
+		// CRON ADD <name> "<spec>" <task>, CRON DEL <name> or CRON LIST
+		if command == "cron" {
+			op, err := parseCronCommand(msg)
+			if err != nil {
+				fmt.Fprintf(conn, "Invalid Cron: %v\n", err)
+				continue
+			}
+			tqs.cronCh <- op
+			res := <-op.respCh
+			if res.Err != nil {
+				fmt.Fprintf(conn, "CRON %s failed: %v\n", strings.ToUpper(op.action), res.Err)
+				continue
+			}
+			switch op.action {
+			case "add":
+				fmt.Fprintf(conn, "Cron %s added, next run %s\n", op.job.Name, res.Jobs[0].Next.Format(time.RFC3339))
+			case "del":
+				fmt.Fprintf(conn, "Cron %s deleted\n", op.job.Name)
+			case "list":
+				if len(res.Jobs) == 0 {
+					fmt.Fprintf(conn, "No cron tasks\n")
+				}
+				for _, job := range res.Jobs {
+					fmt.Fprintf(conn, "%s \"%s\" %s[p=%s]: %s, next run %s\n", job.Name, job.Spec, job.Task.Queue,
+						priorityNames[job.Task.Priority], job.Task.Content, job.Next.Format(time.RFC3339))
+				}
+			}
+			continue
+		}
+
+		// ACK <id>, NACK <id> or EXTEND <id> on a task got from NEXT
+		if command == "ack" || command == "nack" || command == "extend" {
+			id := 0
+			if len(fields) == 2 {
+				id, err = strconv.Atoi(fields[1])
+			}
+			if len(fields) != 2 || err != nil {
+				fmt.Fprintf(conn, "Usage: %s <id>\n", strings.ToUpper(command))
+				continue
+			}
+			op := LeaseOp{action: command, id: id, owner: conn.RemoteAddr().String(), respCh: make(chan LeaseResult)}
+			tqs.leaseCh <- op
+			res := <-op.respCh
+			if res.Err != nil {
+				fmt.Fprintf(conn, "%s failed: %v\n", strings.ToUpper(command), res.Err)
+				continue
+			}
+			switch command {
+			case "ack":
+				fmt.Fprintf(conn, "Task %d done\n", id)
+			case "nack":
+				fmt.Fprintf(conn, "Task %d released\n", id)
+			case "extend":
+				fmt.Fprintf(conn, "Task %d lease extended by %s\n", id, res.LeaseTime)
+			}
+			continue
+		}
+
+		if isTaskCommand(msg) {
+			// parse the task name and its options
+			task, err := parseTask(msg)
+			if err != nil {
+				fmt.Fprintf(conn, "Invalid Task: %v\n", err)
 				continue
 			}
 			// create struct with receiver channel and task to send it to the stateful goroutine
-			submit := SubmitOp{task: Task{Content: msg}, respCh: make(chan bool)}
+			submit := SubmitOp{task: task, respCh: make(chan error)}
 			tqs.submitCh <- submit
-			if <-submit.respCh {
-				fmt.Fprintf(conn, "Task have been submitted successfully\n")
+			if err := <-submit.respCh; err != nil {
+				fmt.Fprintf(conn, "Task rejected: %v\n", err)
 				continue
 			}
+			// an AT time in the past is ready right away
+			if task.RunAt.After(time.Now()) {
+				fmt.Fprintf(conn, "Task have been scheduled for %s\n", task.RunAt.Format(time.RFC3339))
+				continue
+			}
+			fmt.Fprintf(conn, "Task have been submitted successfully\n")
+			continue
 		}
 		fmt.Fprintf(conn, "Unknown command: %s\n", msg)
 	}
 
 }
 
+// a task command starts with "task" followed by a space, an option list or the colon
+func isTaskCommand(msg string) bool {
+	msg = strings.ToLower(msg)
+	if !strings.HasPrefix(msg, "task") || len(msg) == 4 || !strings.Contains(msg, ":") {
+		return false
+	}
+	return msg[4] == ' ' || msg[4] == '[' || msg[4] == ':'
+}
+
+// parse "Task: <content>", "Task[p=high]: <content>", "Task email[p=high]: <content>"
+// and the delayed "Task email AT <rfc3339>: <content>" or "Task IN 10m: <content>".
+// the content is lowercased like it always was. priority is normal and the queue
+// is the default one when not given
+func parseTask(msg string) (Task, error) {
+	// the header ends at the first colon followed by a space, the colons
+	// of an AT time are followed by digits
+	colon := strings.Index(msg, ": ")
+	if colon < 0 {
+		colon = strings.Index(msg, ":")
+	}
+	header := msg[len("task"):colon]
+	task := Task{Content: strings.ToLower(strings.TrimSpace(msg[colon+1:])), Queue: defaultQueue, Priority: PriorityNormal}
+
+	// the options are in brackets, the queue name and the delay are words around them
+	options := ""
+	if i := strings.Index(header, "["); i >= 0 {
+		j := strings.Index(header, "]")
+		if j < i {
+			return task, errors.New("options must be in brackets like [p=high]")
+		}
+		header, options = header[:i]+" "+header[j+1:], strings.ToLower(header[i+1:j])
+	}
+
+	words := strings.Fields(header)
+	if n := len(words); n >= 2 && (strings.ToLower(words[n-2]) == "at" || strings.ToLower(words[n-2]) == "in") {
+		var err error
+		task.RunAt, err = parseDelay(strings.ToLower(words[n-2]), words[n-1], time.Now())
+		if err != nil {
+			return task, err
+		}
+		words = words[:n-2]
+	}
+	switch len(words) {
+	case 0:
+	case 1:
+		name := strings.ToLower(words[0])
+		if !validQueueName(name) {
+			return task, fmt.Errorf("invalid queue name %q", name)
+		}
+		task.Queue = name
+	default:
+		return task, fmt.Errorf("unknown option %q", strings.Join(words, " "))
+	}
+
+	if options != "" {
+		for _, opt := range strings.Split(options, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+			switch key {
+			case "p", "priority":
+				p, ok := parsePriority(value)
+				if !ok {
+					return task, fmt.Errorf("priority must be low, normal or high")
+				}
+				task.Priority = p
+			default:
+				return task, fmt.Errorf("unknown option %q", key)
+			}
+		}
+	}
+	if task.Content == "" {
+		return task, errors.New("empty task")
+	}
+	return task, nil
+}
+
+// when a delayed task becomes due, "at" takes an RFC3339 time and "in" a duration from now
+func parseDelay(kind, value string, now time.Time) (time.Time, error) {
+	if kind == "at" {
+		// accept lowercase t and z as well, the rest of the message is case insensitive
+		at, err := time.Parse(time.RFC3339, strings.ToUpper(value))
+		if err != nil {
+			return time.Time{}, errors.New("AT needs an RFC3339 time like 2024-05-01T09:00:00Z")
+		}
+		return at, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, errors.New("IN needs a duration like 90s or 10m")
+	}
+	return now.Add(d), nil
+}
+
+// parse "<name> [maxlen <n>] [lease <duration>]" of the QUEUE command
+func parseQueueConfig(args []string) (ConfigOp, error) {
+	op := ConfigOp{respCh: make(chan QueueSettings)}
+	if len(args) == 0 || len(args)%2 == 0 {
+		return op, errors.New("usage: QUEUE <name> [MAXLEN <n>] [LEASE <duration>]")
+	}
+	if !validQueueName(args[0]) {
+		return op, fmt.Errorf("invalid queue name %q", args[0])
+	}
+	op.queue = args[0]
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "maxlen":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return op, errors.New("maxlen must be a number, 0 means no limit")
+			}
+			op.maxLen = &n
+		case "lease":
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				return op, errors.New("lease must be a duration like 30s or 5m")
+			}
+			op.leaseTime = &d
+		default:
+			return op, fmt.Errorf("unknown setting %q", args[i])
+		}
+	}
+	return op, nil
+}
+
+// parse `ADD <name> "<spec>" <task>`, `DEL <name>` or `LIST` after CRON. the task is
+// written like after TASK, "email[p=high]: send digest", or just the content for
+// the default queue
+func parseCronCommand(msg string) (CronOp, error) {
+	op := CronOp{respCh: make(chan CronResult)}
+	action, rest, _ := strings.Cut(strings.TrimSpace(msg[len("cron"):]), " ")
+	op.action = strings.ToLower(action)
+	rest = strings.TrimSpace(rest)
+
+	switch op.action {
+	case "list":
+		if rest != "" {
+			return op, errors.New("usage: CRON LIST")
+		}
+		return op, nil
+	case "del":
+		op.job.Name = strings.ToLower(rest)
+		if !validQueueName(op.job.Name) {
+			return op, errors.New("usage: CRON DEL <name>")
+		}
+		return op, nil
+	case "add":
+	default:
+		return op, errors.New(`usage: CRON ADD <name> "<spec>" <task>, CRON DEL <name> or CRON LIST`)
+	}
+
+	name, rest, _ := strings.Cut(rest, " ")
+	op.job.Name = strings.ToLower(name)
+	if !validQueueName(op.job.Name) {
+		return op, fmt.Errorf("invalid cron name %q", name)
+	}
+	rest = strings.TrimSpace(rest)
+	end := -1
+	if strings.HasPrefix(rest, `"`) {
+		end = strings.Index(rest[1:], `"`)
+	}
+	if end < 0 {
+		return op, errors.New(`the cron expression must be in quotes like "0 2 * * *"`)
+	}
+	op.job.Spec = strings.Join(strings.Fields(strings.ToLower(rest[1:end+1])), " ")
+	sched, err := parseCron(op.job.Spec)
+	if err != nil {
+		return op, err
+	}
+	op.job.sched = sched
+
+	content := strings.TrimSpace(rest[end+2:])
+	if isCronTaskHeader(content) {
+		op.job.Task, err = parseTask("task " + content)
+		if err != nil {
+			return op, err
+		}
+		if !op.job.Task.RunAt.IsZero() {
+			return op, errors.New("cron tasks can't be delayed, the schedule says when they run")
+		}
+	} else {
+		op.job.Task = Task{Content: strings.ToLower(content), Queue: defaultQueue, Priority: PriorityNormal}
+	}
+	if op.job.Task.Content == "" {
+		return op, errors.New("empty task")
+	}
+	return op, nil
+}
+
+// true when the cron task starts like after TASK, a queue name and options in
+// brackets followed by a colon like "email[p=high]: send digest". an IN delay
+// counts too so it gets rejected. any other colon is part of the content, like
+// in "run at 10:00"
+func isCronTaskHeader(content string) bool {
+	head, _, ok := strings.Cut(content, ":")
+	if !ok {
+		return false
+	}
+	if i := strings.Index(head, "["); i >= 0 {
+		j := strings.Index(head, "]")
+		if j < i {
+			return false
+		}
+		head = head[:i] + " " + head[j+1:]
+	}
+	words := strings.Fields(strings.ToLower(head))
+	if n := len(words); n >= 2 && words[n-2] == "in" {
+		if _, err := time.ParseDuration(words[n-1]); err == nil {
+			words = words[:n-2]
+		}
+	}
+	switch len(words) {
+	case 0:
+		return true
+	case 1:
+		return validQueueName(words[0])
+	}
+	return false
+}
+
 func main() {
-	server := NewTaskQueueServer()
+	leaseTime := flag.Duration("lease", 30*time.Second, "default time a worker has to ACK a task from NEXT before it is redelivered")
+	maxLen := flag.Int("max-len", 0, "default max number of tasks waiting in a queue, 0 means no limit")
+	aging := flag.Duration("aging", 0, "move a task one priority up after it waited this long, 0 turns aging off")
+	cronTZ := flag.String("cron-tz", "Local", "timezone the CRON expressions are evaluated in, like UTC or Europe/Berlin")
+	catchUp := flag.String("cron-catchup", CatchUpOnce, "what to do with missed CRON runs: skip, once or all")
+	flag.Parse()
+
+	cronLoc, err := time.LoadLocation(*cronTZ)
+	if err != nil {
+		fmt.Println("Invalid -cron-tz:", err)
+		return
+	}
+	if *catchUp != CatchUpSkip && *catchUp != CatchUpOnce && *catchUp != CatchUpAll {
+		fmt.Println("Invalid -cron-catchup, use skip, once or all")
+		return
+	}
+
+	server := NewTaskQueueServer(QueueSettings{MaxLen: *maxLen, LeaseTime: *leaseTime}, *aging, cronLoc, *catchUp)
 	server.Run() // start the server
 
 	server.client.Wait()
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the values set in a field bit set, for readable failures
+func cronBits(bits uint64) []int {
+	var out []int
+	for n := 0; n < 64; n++ {
+		if bits&(1<<uint(n)) != 0 {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		names    []string
+		want     string
+		err      bool
+	}{
+		{"*", 0, 5, nil, "[0 1 2 3 4 5]", false},
+		{"*/15", 0, 59, nil, "[0 15 30 45]", false},
+		{"5/20", 0, 59, nil, "[5 25 45]", false},
+		{"9-12", 0, 23, nil, "[9 10 11 12]", false},
+		{"1-10/3", 1, 31, nil, "[1 4 7 10]", false},
+		{"1,15,3-4", 1, 31, nil, "[1 3 4 15]", false},
+		{"jan,mar-apr", 1, 12, monthNames, "[1 3 4]", false},
+		{"mon-fri", 0, 7, dayNames, "[1 2 3 4 5]", false},
+		{"60", 0, 59, nil, "", true},
+		{"0", 1, 31, nil, "", true},
+		{"5-1", 0, 59, nil, "", true},
+		{"*/0", 0, 59, nil, "", true},
+		{"*/x", 0, 59, nil, "", true},
+		{"1,,2", 0, 59, nil, "", true},
+		{"foo", 1, 12, monthNames, "", true},
+	}
+	for _, tt := range tests {
+		bits, err := parseCronField(tt.field, tt.min, tt.max, tt.names)
+		if (err != nil) != tt.err || (err == nil && fmt.Sprint(cronBits(bits)) != tt.want) {
+			t.Errorf("%q: %v %v, want %s (error %v)", tt.field, cronBits(bits), err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"0 2 * * *", ""},
+		{"*/15 9-17 * * MON-FRI", ""},
+		{"0 0 1 jan 7", ""},
+		{"0 2 * *", "cron expression needs 5 fields"},
+		{"0 24 * * *", "hour:"},
+		{"0 0 32 * *", "day of month:"},
+		{"0 0 * 13 *", "month:"},
+		{"0 0 * * 8", "day of week:"},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.spec)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.HasPrefix(got, tt.err) || (tt.err == "") != (err == nil) {
+			t.Errorf("%q: %v, want %q", tt.spec, err, tt.err)
+		}
+	}
+
+	sched, _ := parseCron("0 0 * * 7")
+	if fmt.Sprint(cronBits(sched.dow)) != "[0 7]" {
+		t.Errorf("7 is not sunday: %v", cronBits(sched.dow))
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no timezone database:", err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone database:", err)
+	}
+	tests := []struct {
+		spec  string
+		loc   *time.Location
+		after string
+		want  string // the next runs, in the location
+	}{
+		{"*/15 * * * *", time.UTC, "2026-05-01T10:07:00Z", "2026-05-01T10:15:00Z 2026-05-01T10:30:00Z"},
+		{"0 9-10 * * *", time.UTC, "2026-05-01T10:00:00Z", "2026-05-02T09:00:00Z 2026-05-02T10:00:00Z"},
+		{"0 0 1,15 * *", time.UTC, "2026-05-01T00:00:00Z", "2026-05-15T00:00:00Z 2026-06-01T00:00:00Z"},
+		{"30 8 * * mon-fri", time.UTC, "2026-05-01T09:00:00Z", "2026-05-04T08:30:00Z 2026-05-05T08:30:00Z"}, // 1 may is a friday
+		// both day fields restricted: the 13th or a friday
+		{"0 0 13 * fri", time.UTC, "2026-03-01T00:00:00Z", "2026-03-06T00:00:00Z 2026-03-13T00:00:00Z 2026-03-20T00:00:00Z"},
+		// only the weekday restricted: fridays only
+		{"0 0 * * fri", time.UTC, "2026-03-12T00:00:00Z", "2026-03-13T00:00:00Z 2026-03-20T00:00:00Z"},
+		{"0 0 29 feb *", time.UTC, "2026-01-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 9 * * *", newYork, "2026-05-01T12:00:00Z", "2026-05-01T09:00:00-04:00 2026-05-02T09:00:00-04:00"},
+		// 02:30 doesn't exist on 29 march in Berlin, it runs when the clock jumps to 03:00
+		{"30 2 * * *", berlin, "2026-03-28T12:00:00+01:00", "2026-03-29T03:00:00+02:00 2026-03-30T02:30:00+02:00"},
+		{"*/20 2 * * *", berlin, "2026-03-29T00:00:00+01:00", "2026-03-29T03:00:00+02:00 2026-03-30T02:00:00+02:00"},
+		// hourly jobs follow the real hours, the missing hour has no runs
+		{"30 * * * *", berlin, "2026-03-29T01:00:00+01:00", "2026-03-29T01:30:00+01:00 2026-03-29T03:30:00+02:00"},
+		// 02:30 happens twice on 25 october in Berlin, the job runs at the first one
+		{"30 2 * * *", berlin, "2026-10-24T12:00:00+02:00", "2026-10-25T02:30:00+02:00 2026-10-26T02:30:00+01:00"},
+		// even when asked during the second pass of the repeated hour
+		{"30 2 * * *", berlin, "2026-10-25T02:10:00+01:00", "2026-10-26T02:30:00+01:00"},
+		// hourly jobs run in both passes
+		{"30 * * * *", berlin, "2026-10-25T02:00:00+02:00", "2026-10-25T02:30:00+02:00 2026-10-25T02:30:00+01:00 2026-10-25T03:30:00+01:00"},
+		{"*/30 * * * *", berlin, "2026-10-25T02:40:00+02:00", "2026-10-25T02:00:00+01:00 2026-10-25T02:30:00+01:00"},
+	}
+	for _, tt := range tests {
+		sched, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at, err := time.Parse(time.RFC3339, tt.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runs []string
+		for range strings.Fields(tt.want) {
+			at = sched.next(at, tt.loc)
+			runs = append(runs, at.Format(time.RFC3339))
+		}
+		if got := strings.Join(runs, " "); got != tt.want {
+			t.Errorf("%q after %s in %s:\n got %s\nwant %s", tt.spec, tt.after, tt.loc, got, tt.want)
+		}
+	}
+
+	never, _ := parseCron("0 0 30 2 *")
+	if at := never.next(time.Now(), time.UTC); !at.IsZero() {
+		t.Errorf("30 february fires at %s", at)
+	}
+}
+
+// missed runs are dropped, run once or run each, and on time runs always run
+func TestCronCatchUp(t *testing.T) {
+	sched, _ := parseCron("*/10 * * * *")
+	start := time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		policy string
+		now    time.Time
+		runs   int
+	}{
+		{CatchUpSkip, start.Add(30 * time.Second), 1},
+		{CatchUpOnce, start.Add(30 * time.Second), 1},
+		{CatchUpAll, start.Add(30 * time.Second), 1},
+		// 10:00 to 10:30 were missed, 10:40 is on time
+		{CatchUpSkip, start.Add(40*time.Minute + 10*time.Second), 1},
+		{CatchUpOnce, start.Add(40*time.Minute + 10*time.Second), 2},
+		{CatchUpAll, start.Add(40*time.Minute + 10*time.Second), 5},
+		// only missed runs
+		{CatchUpSkip, start.Add(25 * time.Minute), 0},
+		{CatchUpOnce, start.Add(25 * time.Minute), 1},
+		{CatchUpAll, start.Add(25 * time.Minute), 3},
+		// a long sleep is capped
+		{CatchUpAll, start.Add(48 * time.Hour), maxCatchUp},
+	}
+	for _, tt := range tests {
+		job := &cronJob{Name: "test", sched: sched, Next: start}
+		if runs := job.dueRuns(tt.now, time.UTC, tt.policy); runs != tt.runs {
+			t.Errorf("%s at %s: %d runs, want %d", tt.policy, tt.now.Format("15:04:05"), runs, tt.runs)
+		}
+		if !job.Next.After(tt.now) || job.Next.Sub(tt.now) > 10*time.Minute {
+			t.Errorf("%s at %s: next run %s", tt.policy, tt.now.Format("15:04:05"), job.Next)
+		}
+	}
+}
+
+func TestParseCronCommand(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string // action, name, spec, queue, priority and content
+		err  bool
+	}{
+		{"CRON LIST", "list", false},
+		{"cron del Nightly", "del nightly", false},
+		{`CRON ADD nightly "0 2 * * *" build report`, `add nightly "0 2 * * *" default normal build report`, false},
+		{`CRON ADD nightly "0  2 * *  *" reports[p=high]: Build Report`, `add nightly "0 2 * * *" reports high build report`, false},
+		{`CRON ADD n "0 2 * * *" [p=low]: x`, `add n "0 2 * * *" default low x`, false},
+		{`CRON ADD n "0 2 * * *" email: send at 10:00`, `add n "0 2 * * *" email normal send at 10:00`, false},
+		// a colon that doesn't follow a queue name is part of the content
+		{`CRON ADD n "0 2 * * *" run at 10:00`, `add n "0 2 * * *" default normal run at 10:00`, false},
+		{`CRON ADD n "0 2 * * *" check https://example.com`, `add n "0 2 * * *" default normal check https://example.com`, false},
+		{"CRON LIST all", "", true},
+		{"CRON DEL", "", true},
+		{"CRON RUN x", "", true},
+		{`CRON ADD n 0 2 * * * x`, "", true},
+		{`CRON ADD n "0 2 * *" x`, "", true},
+		{`CRON ADD n "0 2 * * *"`, "", true},
+		{`CRON ADD n "0 2 * * *" email[p=urgent]: x`, "", true},
+		{`CRON ADD n "0 2 * * *" email IN 5m: x`, "", true},
+		{`CRON ADD bad/name "0 2 * * *" x`, "", true},
+	}
+	for _, tt := range tests {
+		op, err := parseCronCommand(tt.msg)
+		got := strings.TrimSpace(op.action + " " + op.job.Name)
+		if op.action == "add" && err == nil {
+			task := op.job.Task
+			got += fmt.Sprintf(" %q %s %s %s", op.job.Spec, task.Queue, priorityNames[task.Priority], task.Content)
+		}
+		if (err != nil) != tt.err || (err == nil && got != tt.want) {
+			t.Errorf("%s: %q %v, want %q (error %v)", tt.msg, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// a server with its stateful goroutine running, the tests talk to it over the channels
+func startQueue(defaults QueueSettings, aging time.Duration) *TaskQueueServer {
+	tqs := NewTaskQueueServer(defaults, aging, time.UTC, CatchUpOnce)
+	go tqs.manageQueue()
+	return tqs
+}
+
+func (tqs *TaskQueueServer) testSubmit(t *testing.T, task Task) {
+	t.Helper()
+	op := SubmitOp{task: task, respCh: make(chan error)}
+	tqs.submitCh <- op
+	if err := <-op.respCh; err != nil {
+		t.Fatalf("submit %q: %v", task.Content, err)
+	}
+}
+
+func (tqs *TaskQueueServer) testNext(queue, owner string) *Task {
+	op := NextOp{queue: queue, owner: owner, respCh: make(chan *Task)}
+	tqs.nextCh <- op
+	return <-op.respCh
+}
+
+func (tqs *TaskQueueServer) testLease(action string, id int, owner string) LeaseResult {
+	op := LeaseOp{action: action, id: id, owner: owner, respCh: make(chan LeaseResult)}
+	tqs.leaseCh <- op
+	return <-op.respCh
+}
+
+func (tqs *TaskQueueServer) testStatus(queue string) Status {
+	op := StatusOp{queue: queue, respCh: make(chan Status)}
+	tqs.statusCh <- op
+	return <-op.respCh
+}
+
+// poll the status until ok accepts it, the ticker and the due timer run on their own
+func (tqs *TaskQueueServer) waitStatus(queue string, within time.Duration, ok func(Status) bool) (Status, bool) {
+	deadline := time.Now().Add(within)
+	for {
+		st := tqs.testStatus(queue)
+		if ok(st) || time.Now().After(deadline) {
+			return st, ok(st)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLeaseAckNackExtend(t *testing.T) {
+	tqs := startQueue(QueueSettings{LeaseTime: time.Minute}, 0)
+	for _, content := range []string{"first", "second"} {
+		tqs.testSubmit(t, Task{Content: content, Queue: defaultQueue, Priority: PriorityNormal})
+	}
+
+	first := tqs.testNext(defaultQueue, "worker-a")
+	if first == nil || first.Content != "first" || first.Attempts != 1 {
+		t.Fatalf("NEXT gave %+v", first)
+	}
+	if st := tqs.testStatus(defaultQueue); st.Ready != 1 || st.Leased != 1 {
+		t.Errorf("after NEXT: %d ready, %d leased", st.Ready, st.Leased)
+	}
+
+	// only the owner can touch the lease
+	for _, action := range []string{"ack", "nack", "extend"} {
+		if res := tqs.testLease(action, first.ID, "worker-b"); res.Err == nil || !strings.Contains(res.Err.Error(), "another client") {
+			t.Errorf("%s by another client: %v", action, res.Err)
+		}
+	}
+
+	if res := tqs.testLease("extend", first.ID, "worker-a"); res.Err != nil || res.LeaseTime != time.Minute {
+		t.Errorf("EXTEND: %+v", res)
+	}
+
+	// a NACKed task is handed out again before the tasks that waited behind it
+	if res := tqs.testLease("nack", first.ID, "worker-a"); res.Err != nil {
+		t.Fatalf("NACK: %v", res.Err)
+	}
+	again := tqs.testNext(defaultQueue, "worker-b")
+	if again == nil || again.ID != first.ID || again.Attempts != 2 {
+		t.Fatalf("NEXT after NACK gave %+v, want task %d again", again, first.ID)
+	}
+
+	if res := tqs.testLease("ack", again.ID, "worker-b"); res.Err != nil {
+		t.Fatalf("ACK: %v", res.Err)
+	}
+	if st := tqs.testStatus(defaultQueue); st.Ready != 1 || st.Leased != 0 {
+		t.Errorf("after ACK: %d ready, %d leased", st.Ready, st.Leased)
+	}
+	// an acknowledged task is gone, there is nothing left to ACK or NACK
+	for _, action := range []string{"ack", "nack", "extend"} {
+		if res := tqs.testLease(action, again.ID, "worker-b"); res.Err == nil || !strings.Contains(res.Err.Error(), "not leased") {
+			t.Errorf("%s after ACK: %v", action, res.Err)
+		}
+	}
+	if next := tqs.testNext(defaultQueue, "worker-a"); next == nil || next.Content != "second" {
+		t.Errorf("NEXT gave %+v, want second", next)
+	}
+	if next := tqs.testNext(defaultQueue, "worker-a"); next != nil {
+		t.Errorf("NEXT of an empty queue gave %+v", next)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	tqs := startQueue(QueueSettings{LeaseTime: 300 * time.Millisecond}, 0)
+	for _, content := range []string{"expires", "kept", "waits"} {
+		tqs.testSubmit(t, Task{Content: content, Queue: defaultQueue, Priority: PriorityNormal})
+	}
+	expires := tqs.testNext(defaultQueue, "worker-a")
+	kept := tqs.testNext(defaultQueue, "worker-a")
+
+	// keep one lease alive with EXTEND while the other runs out
+	deadline := time.Now().Add(3 * tickInterval)
+	for time.Now().Before(deadline) {
+		if res := tqs.testLease("extend", kept.ID, "worker-a"); res.Err != nil {
+			t.Fatalf("EXTEND: %v", res.Err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	st, ok := tqs.waitStatus(defaultQueue, 2*tickInterval, func(st Status) bool { return st.Leased == 1 })
+	if !ok || st.Ready != 2 {
+		t.Fatalf("after the lease ran out: %d ready, %d leased", st.Ready, st.Leased)
+	}
+
+	// the expired task goes before the one that waited, and the old owner lost it
+	if res := tqs.testLease("ack", expires.ID, "worker-a"); res.Err == nil {
+		t.Error("ACK of an expired lease worked")
+	}
+	again := tqs.testNext(defaultQueue, "worker-b")
+	if again == nil || again.ID != expires.ID || again.Attempts != 2 {
+		t.Errorf("NEXT gave %+v, want the expired task %d", again, expires.ID)
+	}
+	if res := tqs.testLease("ack", kept.ID, "worker-a"); res.Err != nil {
+		t.Errorf("ACK of the extended lease: %v", res.Err)
+	}
+}
+
+// the ids in each priority level, lowest level first
+func levelIDs(pq *priorityQueue) string {
+	var levels [numPriorities][]int
+	for p, level := range pq.levels {
+		for _, task := range level {
+			levels[p] = append(levels[p], task.ID)
+		}
+	}
+	return fmt.Sprint(levels)
+}
+
+func TestPriorityQueueAge(t *testing.T) {
+	now := time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC)
+	var pq priorityQueue
+	pq.push(Task{ID: 1, Priority: PriorityLow, waitingSince: now.Add(-time.Hour)})
+	pq.push(Task{ID: 2, Priority: PriorityLow, waitingSince: now.Add(-time.Second)})
+	pq.push(Task{ID: 3, Priority: PriorityNormal, waitingSince: now.Add(-time.Hour)})
+	pq.push(Task{ID: 4, Priority: PriorityHigh, waitingSince: now.Add(-time.Hour)})
+	// a redelivered task at the front of its level with an old waiting time
+	pq.push(Task{ID: 5, Priority: PriorityNormal, waitingSince: now})
+	pq.pushFront(Task{ID: 6, Priority: PriorityNormal, waitingSince: now.Add(-time.Hour)})
+
+	// task 1 waited long enough for two levels but moves only one
+	pq.age(now, time.Minute)
+	if got := levelIDs(&pq); got != "[[2] [5 1] [4 6 3]]" {
+		t.Errorf("after the first check: %s", got)
+	}
+	// promoted tasks start waiting again in their new level
+	pq.age(now.Add(30*time.Second), time.Minute)
+	if got := levelIDs(&pq); got != "[[2] [5 1] [4 6 3]]" {
+		t.Errorf("after 30s: %s", got)
+	}
+	pq.age(now.Add(time.Minute), time.Minute)
+	if got := levelIDs(&pq); got != "[[] [2] [4 6 3 5 1]]" {
+		t.Errorf("after a minute: %s", got)
+	}
+	for _, task := range pq.levels[PriorityHigh] {
+		if task.Priority != PriorityHigh {
+			t.Errorf("task %d is in the high level with priority %d", task.ID, task.Priority)
+		}
+	}
+	if pq.len() != 6 {
+		t.Errorf("%d tasks after aging, want 6", pq.len())
+	}
+}
+
+// NACKed and expired tasks go back with the waiting time they had, so a task
+// that keeps failing is promoted as if it never left its level
+func TestAgingKeepsWaitingTime(t *testing.T) {
+	const aging = 2 * time.Second
+	tqs := startQueue(QueueSettings{LeaseTime: time.Minute}, aging)
+	tqs.testSubmit(t, Task{Content: "nacked", Queue: "nacked", Priority: PriorityLow})
+	tqs.testSubmit(t, Task{Content: "expired", Queue: "expired", Priority: PriorityLow})
+	lease := aging + 200*time.Millisecond
+	config := ConfigOp{queue: "expired", leaseTime: &lease, respCh: make(chan QueueSettings)}
+	tqs.configCh <- config
+	<-config.respCh
+
+	nacked := tqs.testNext("nacked", "worker")
+	if expired := tqs.testNext("expired", "worker"); nacked == nil || expired == nil {
+		t.Fatal("NEXT gave no task")
+	}
+	// leased tasks don't age
+	time.Sleep(aging + 200*time.Millisecond)
+	if st := tqs.testStatus("nacked"); st.Leased != 1 || st.Ready != 0 {
+		t.Fatalf("the leased task moved: %+v", st)
+	}
+	if res := tqs.testLease("nack", nacked.ID, "worker"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	// with a fresh waiting time the tasks would need another 2s
+	promoted := func(st Status) bool { return st.ByPriority[PriorityNormal] == 1 }
+	for _, queue := range []string{"nacked", "expired"} {
+		if st, ok := tqs.waitStatus(queue, 3*tickInterval, promoted); !ok {
+			t.Errorf("%s task was not promoted right away: %+v", queue, st)
+		}
+	}
+}
+
+func (tqs *TaskQueueServer) testConfig(t *testing.T, args string) QueueSettings {
+	t.Helper()
+	op, err := parseQueueConfig(strings.Fields(args))
+	if err != nil {
+		t.Fatalf("QUEUE %s: %v", args, err)
+	}
+	tqs.configCh <- op
+	return <-op.respCh
+}
+
+func (tqs *TaskQueueServer) testQueues() string {
+	op := QueuesOp{respCh: make(chan []Status)}
+	tqs.queuesCh <- op
+	var names []string
+	for _, st := range <-op.respCh {
+		names = append(names, fmt.Sprintf("%s:%d", st.Queue, st.Ready))
+	}
+	return strings.Join(names, " ")
+}
+
+func TestParseQueueConfig(t *testing.T) {
+	tests := []struct {
+		args string
+		want string // queue, max length and lease, - when not set
+		err  bool
+	}{
+		{"email", "email - -", false},
+		{"email maxlen 10", "email 10 -", false},
+		{"email lease 5m maxlen 0", "email 0 5m0s", false},
+		{"", "", true},
+		{"email maxlen", "", true},
+		{"email maxlen -1", "", true},
+		{"email lease 0s", "", true},
+		{"email lease soon", "", true},
+		{"email color red", "", true},
+		{"bad/name", "", true},
+	}
+	for _, tt := range tests {
+		op, err := parseQueueConfig(strings.Fields(tt.args))
+		maxLen, lease := "-", "-"
+		if op.maxLen != nil {
+			maxLen = fmt.Sprint(*op.maxLen)
+		}
+		if op.leaseTime != nil {
+			lease = op.leaseTime.String()
+		}
+		got := op.queue + " " + maxLen + " " + lease
+		if (err != nil) != tt.err || (err == nil && got != tt.want) {
+			t.Errorf("%q: %q %v, want %q (error %v)", tt.args, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestNamedQueues(t *testing.T) {
+	tqs := startQueue(QueueSettings{LeaseTime: time.Minute}, 0)
+	tqs.testSubmit(t, Task{Content: "welcome", Queue: "email", Priority: PriorityNormal})
+	tqs.testSubmit(t, Task{Content: "resize", Queue: "images", Priority: PriorityNormal})
+	tqs.testSubmit(t, Task{Content: "digest", Queue: "email", Priority: PriorityNormal})
+
+	// asking for a queue that doesn't exist doesn't create it
+	if next := tqs.testNext("missing", "worker"); next != nil {
+		t.Errorf("NEXT of an unknown queue gave %+v", next)
+	}
+	if st := tqs.testStatus("missing"); st.Ready != 0 || st.Settings.LeaseTime != time.Minute {
+		t.Errorf("STATUS of an unknown queue: %+v", st)
+	}
+	if settings := tqs.testConfig(t, "missing"); settings.LeaseTime != time.Minute || settings.MaxLen != 0 {
+		t.Errorf("QUEUE of an unknown queue: %+v", settings)
+	}
+	if got := tqs.testQueues(); got != "email:2 images:1" {
+		t.Errorf("QUEUES: %s", got)
+	}
+
+	// every queue hands out only its own tasks, ids are shared
+	if next := tqs.testNext("images", "worker"); next == nil || next.Content != "resize" || next.ID != 2 {
+		t.Errorf("NEXT images gave %+v", next)
+	}
+	if next := tqs.testNext("images", "worker"); next != nil {
+		t.Errorf("NEXT images gave %+v after its only task", next)
+	}
+	if next := tqs.testNext("email", "worker"); next == nil || next.Content != "welcome" {
+		t.Errorf("NEXT email gave %+v", next)
+	}
+	if st := tqs.testStatus("email"); st.Ready != 1 || st.Leased != 1 {
+		t.Errorf("STATUS email: %+v", st)
+	}
+	if st := tqs.testStatus("images"); st.Ready != 0 || st.Leased != 1 {
+		t.Errorf("STATUS images: %+v", st)
+	}
+
+	// a setting creates the queue
+	tqs.testConfig(t, "reports lease 5s")
+	if got := tqs.testQueues(); got != "email:1 images:0 reports:0" {
+		t.Errorf("QUEUES: %s", got)
+	}
+}
+
+func TestQueueSettings(t *testing.T) {
+	tqs := startQueue(QueueSettings{LeaseTime: time.Minute}, 0)
+	if settings := tqs.testConfig(t, "small maxlen 2 lease 300ms"); settings.MaxLen != 2 || settings.LeaseTime != 300*time.Millisecond {
+		t.Errorf("QUEUE small: %+v", settings)
+	}
+	// the other setting is kept
+	if settings := tqs.testConfig(t, "small maxlen 1"); settings.MaxLen != 1 || settings.LeaseTime != 300*time.Millisecond {
+		t.Errorf("QUEUE small maxlen 1: %+v", settings)
+	}
+	tqs.testSubmit(t, Task{Content: "one", Queue: "small", Priority: PriorityNormal})
+	op := SubmitOp{task: Task{Content: "two", Queue: "small", Priority: PriorityNormal}, respCh: make(chan error)}
+	tqs.submitCh <- op
+	if err := <-op.respCh; err == nil || !strings.Contains(err.Error(), "queue small is full") {
+		t.Errorf("second task in a full queue: %v", err)
+	}
+	// other queues have no limit
+	for i := 0; i < 3; i++ {
+		tqs.testSubmit(t, Task{Content: "big", Queue: "big", Priority: PriorityNormal})
+	}
+
+	// leased tasks don't count towards the limit
+	small := tqs.testNext("small", "worker")
+	big := tqs.testNext("big", "worker")
+	tqs.testSubmit(t, Task{Content: "two", Queue: "small", Priority: PriorityNormal})
+
+	// EXTEND uses the lease time of the task's queue
+	if res := tqs.testLease("extend", big.ID, "worker"); res.LeaseTime != time.Minute {
+		t.Errorf("EXTEND of a task from big: %+v", res)
+	}
+	if res := tqs.testLease("extend", small.ID, "worker"); res.LeaseTime != 300*time.Millisecond {
+		t.Errorf("EXTEND of a task from small: %+v", res)
+	}
+	// only the short lease runs out, and redelivered tasks get past the limit
+	if st, ok := tqs.waitStatus("small", 3*tickInterval, func(st Status) bool { return st.Leased == 0 }); !ok || st.Ready != 2 {
+		t.Errorf("STATUS small after its lease ran out: %+v", st)
+	}
+	if st := tqs.testStatus("big"); st.Leased != 1 {
+		t.Errorf("STATUS big: %+v", st)
+	}
+}
+
+func TestTaskHeap(t *testing.T) {
+	now := time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC)
+	var h taskHeap
+	for id, delay := range []time.Duration{30, 10, 20, 10, 5} {
+		heap.Push(&h, Task{ID: id + 1, RunAt: now.Add(delay * time.Second)})
+	}
+	var order []int
+	for h.Len() > 0 {
+		order = append(order, heap.Pop(&h).(Task).ID)
+	}
+	// due time first, ties in submit order
+	if got := fmt.Sprint(order); got != "[5 2 4 3 1]" {
+		t.Errorf("due order %s", got)
+	}
+}
+
+func TestDelayedTasks(t *testing.T) {
+	tqs := startQueue(QueueSettings{LeaseTime: time.Minute}, 0)
+	now := time.Now()
+	// submitted out of order, they must become ready in the order they are due
+	for _, delay := range []time.Duration{600 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		tqs.testSubmit(t, Task{Content: delay.String(), Queue: defaultQueue, Priority: PriorityNormal, RunAt: now.Add(delay)})
+	}
+	// an AT time in the past is ready right away
+	tqs.testSubmit(t, Task{Content: "late", Queue: defaultQueue, Priority: PriorityNormal, RunAt: now.Add(-time.Minute)})
+
+	if st := tqs.testStatus(defaultQueue); st.Ready != 1 || st.Scheduled != 3 {
+		t.Errorf("after submitting: %d ready, %d scheduled", st.Ready, st.Scheduled)
+	}
+	if next := tqs.testNext(defaultQueue, "worker"); next == nil || next.Content != "late" {
+		t.Fatalf("NEXT gave %+v, want the task that was already due", next)
+	}
+	if next := tqs.testNext(defaultQueue, "worker"); next != nil {
+		t.Fatalf("NEXT gave %+v before anything was due", next)
+	}
+
+	st, ok := tqs.waitStatus(defaultQueue, time.Second, func(st Status) bool { return st.Scheduled < 3 })
+	if !ok || st.Ready != 1 || st.Scheduled != 2 {
+		t.Errorf("after the first was due: %d ready, %d scheduled", st.Ready, st.Scheduled)
+	}
+	if st, ok := tqs.waitStatus(defaultQueue, time.Second, func(st Status) bool { return st.Scheduled == 0 }); !ok || st.Ready != 3 {
+		t.Errorf("after all were due: %d ready, %d scheduled", st.Ready, st.Scheduled)
+	}
+	var order []string
+	for next := tqs.testNext(defaultQueue, "worker"); next != nil; next = tqs.testNext(defaultQueue, "worker") {
+		order = append(order, next.Content)
+	}
+	if got := strings.Join(order, " "); got != "200ms 400ms 600ms" {
+		t.Errorf("NEXT order %s", got)
+	}
+}
+
+// scheduled tasks count towards MAXLEN, else the queue overflows when they are due
+func TestDelayedTasksMaxLen(t *testing.T) {
+	tqs := startQueue(QueueSettings{LeaseTime: time.Minute, MaxLen: 1}, 0)
+	tqs.testSubmit(t, Task{Content: "later", Queue: defaultQueue, Priority: PriorityNormal, RunAt: time.Now().Add(time.Hour)})
+	op := SubmitOp{task: Task{Content: "now", Queue: defaultQueue, Priority: PriorityNormal}, respCh: make(chan error)}
+	tqs.submitCh <- op
+	if err := <-op.respCh; err == nil {
+		t.Error("a full queue took a task")
+	}
+	if got := tqs.testQueues(); got != "default:0" {
+		t.Errorf("QUEUES: %s", got)
+	}
+}
+
+func TestParseTaskDelay(t *testing.T) {
+	at := time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		msg   string
+		queue string
+		runAt time.Time
+		err   bool
+	}{
+		{"task: x", defaultQueue, time.Time{}, false},
+		{"task email AT 2026-05-01T09:00:00Z: x", "email", at, false},
+		{"task at 2026-05-01t09:00:00z: x", defaultQueue, at, false},
+		{"task email[p=high] at 2026-05-01T11:00:00+02:00: x", "email", at, false},
+		{"task at tomorrow: x", "", time.Time{}, true},
+		{"task in -5m: x", "", time.Time{}, true},
+		{"task email in 5 minutes: x", "", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		task, err := parseTask(tt.msg)
+		if (err != nil) != tt.err || (err == nil && (task.Queue != tt.queue || !task.RunAt.Equal(tt.runAt) || task.Content != "x")) {
+			t.Errorf("%q: %+v %v", tt.msg, task, err)
+		}
+	}
+
+	task, err := parseTask("task email IN 10m: x")
+	if wait := time.Until(task.RunAt); err != nil || wait < 9*time.Minute || wait > 10*time.Minute {
+		t.Errorf("IN 10m: %+v %v", task, err)
+	}
+}
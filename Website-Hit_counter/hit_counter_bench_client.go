@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throughput benchmark of the tcp protocol: every connection sends its hits as fast as
+// it can, in batches of commands per write, and reads the answers on its own goroutine
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address of the hit counter server")
+	conns := flag.Int("conns", 4, "number of connections")
+	hits := flag.Int("hits", 100000, "hits sent by each connection")
+	pages := flag.Int("pages", 100, "number of different pages the hits go to")
+	mode := flag.String("mode", "hits", "how hits are sent: get (one GET per hit), hits (HITS with -batch pages) or incrby (INCRBY <page> <batch>)")
+	batch := flag.Int("batch", 100, "pages per HITS or count per INCRBY")
+	quiet := flag.Bool("quiet", true, "send QUIET ON so the server doesn't acknowledge the hits")
+	flag.Parse()
+
+	if *mode != "get" && *mode != "hits" && *mode != "incrby" {
+		fmt.Println("Unknown mode", *mode)
+		return
+	}
+	if *mode == "get" {
+		*batch = 1
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var sent, commands int
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			n, cmds, err := runConn(*addr, id, *hits, *pages, *mode, *batch, *quiet)
+			if err != nil {
+				fmt.Printf("Connection %d: %v\n", id, err)
+			}
+			mu.Lock()
+			sent += n
+			commands += cmds
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	fmt.Printf("mode %s, %d connections, batch %d, quiet %v\n", *mode, *conns, *batch, *quiet)
+	fmt.Printf("%d hits in %d commands in %s\n", sent, commands, elapsed.Round(time.Millisecond))
+	fmt.Printf("%.0f hits/s, %.0f commands/s\n", float64(sent)/elapsed.Seconds(), float64(commands)/elapsed.Seconds())
+}
+
+// send the hits of one connection and wait until the server processed all of them.
+// the last command is QUIET OFF: the server answers commands in order, so its answer
+// means every hit before it was recorded
+func runConn(addr string, id, hits, pages int, mode string, batch int, quiet bool) (int, int, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	// read the answers while we write, else both sides could block on full buffers
+	done := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				done <- err
+				return
+			}
+			if strings.HasPrefix(line, "Quiet mode off") {
+				done <- nil
+				return
+			}
+		}
+	}()
+
+	w := bufio.NewWriterSize(conn, 64*1024)
+	if quiet {
+		fmt.Fprintf(w, "QUIET ON\n")
+	}
+	sent, commands := 0, 0
+	for sent < hits {
+		n := batch
+		if hits-sent < n {
+			n = hits - sent
+		}
+		page := (id + commands) % pages // connections start on different pages
+		switch mode {
+		case "get":
+			fmt.Fprintf(w, "GET /bench/%d\n", page)
+		case "incrby":
+			fmt.Fprintf(w, "INCRBY /bench/%d %d\n", page, n)
+		case "hits":
+			w.WriteString("HITS")
+			for i := 0; i < n; i++ {
+				fmt.Fprintf(w, " /bench/%d", (page*n+i)%pages)
+			}
+			w.WriteString("\n")
+		}
+		sent += n
+		commands++
+	}
+	fmt.Fprintf(w, "QUIET OFF\n")
+	if err := w.Flush(); err != nil {
+		return sent, commands, err
+	}
+	return sent, commands, <-done
+}
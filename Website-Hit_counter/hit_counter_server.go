@@ -5,114 +5,5341 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"hash/maphash"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// a bucket holds the hits that landed in one slot of time (slot = unix time / bucket width)
+type bucket struct {
+	slot  int64
+	count uint64
+}
+
+// fixed size ring of buckets, old slots are overwritten so memory never grows
+type bucketRing struct {
+	width   time.Duration
+	buckets []bucket
+}
+
+func newBucketRing(width time.Duration, size int) *bucketRing {
+	return &bucketRing{width: width, buckets: make([]bucket, size)}
+}
+
+// span is how far back the ring can answer
+func (r *bucketRing) span() time.Duration {
+	return r.width * time.Duration(len(r.buckets))
+}
+
+func (r *bucketRing) add(now time.Time, n uint64) {
+	slot := now.UnixNano() / int64(r.width)
+	b := &r.buckets[slot%int64(len(r.buckets))]
+	if b.slot != slot {
+		// the bucket still holds an old slot so start it again
+		b.slot = slot
+		b.count = 0
+	}
+	b.count += n
+}
+
+// sum the hits of the last d, rounded up to whole buckets (the current bucket is partial)
+func (r *bucketRing) sum(now time.Time, d time.Duration) uint64 {
+	n := int64((d + r.width - 1) / r.width)
+	if n > int64(len(r.buckets)) {
+		n = int64(len(r.buckets))
+	}
+	slot := now.UnixNano() / int64(r.width)
+	var total uint64
+	for i := int64(0); i < n; i++ {
+		b := r.buckets[(slot-i)%int64(len(r.buckets))]
+		if b.slot == slot-i {
+			total += b.count
+		}
+	}
+	return total
+}
+
+// sliding windows with three resolutions: seconds for the last minute,
+// minutes for the last hour and hours for the last day.
+// 60+60+24 buckets per page no matter how much traffic the page gets
+type hitWindows struct {
+	mu    sync.Mutex
+	rings []*bucketRing // ordered from the finest to the coarsest resolution
+}
+
+// width and number of buckets of each ring of hitWindows
+var windowResolutions = []struct {
+	width time.Duration
+	size  int
+}{{time.Second, 60}, {time.Minute, 60}, {time.Hour, 24}}
+
+func newHitWindows() *hitWindows {
+	w := &hitWindows{}
+	for _, res := range windowResolutions {
+		w.rings = append(w.rings, newBucketRing(res.width, res.size))
+	}
+	return w
+}
+
+func (w *hitWindows) add(now time.Time, n uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, r := range w.rings {
+		r.add(now, n)
+	}
+}
+
+func (w *hitWindows) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, r := range w.rings {
+		for i := range r.buckets {
+			r.buckets[i] = bucket{}
+		}
+	}
+}
+
+// add the buckets of other that are still current into w
+func (w *hitWindows) merge(other *hitWindows) {
+	other.mu.Lock()
+	copies := make([][]bucket, len(other.rings))
+	for i, r := range other.rings {
+		copies[i] = append([]bucket(nil), r.buckets...)
+	}
+	other.mu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, r := range w.rings {
+		for j, b := range copies[i] {
+			switch {
+			case b.slot == r.buckets[j].slot:
+				r.buckets[j].count += b.count
+			case b.slot > r.buckets[j].slot:
+				r.buckets[j] = b
+			}
+		}
+	}
+}
+
+// count the hits of the last d using the finest ring that covers it
+func (w *hitWindows) sum(now time.Time, d time.Duration) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, r := range w.rings {
+		if d <= r.span() {
+			return r.sum(now, d), nil
+		}
+	}
+	return 0, fmt.Errorf("window %s is longer than %s", d, maxWindow)
+}
+
+// longest window the server keeps
+const maxWindow = 24 * time.Hour
+
+// 2^10 registers of one byte each, about 3% standard error on the estimate
+const hllPrecision = 10
+
+// a sketch stays sparse up to this many set registers, at 2 bytes each it
+// is half the size of the dense registers
+const hllSparseMax = 1 << hllPrecision / 4
+
+// HyperLogLog sketch to estimate how many different visitors a page had.
+// two sketches merge by taking the max of every register, so hourly sketches
+// can be combined into any longer window. most pages and hours have few
+// visitors, so a sketch starts as a list of its set registers packed as
+// index<<6 | rank, and only allocates every register when the list is full
+type hyperLogLog struct {
+	sparse    []uint16
+	registers []uint8 // nil while the sketch is sparse
+}
+
+// hash the visitor id, fnv alone mixes the high bits badly so finish it with splitmix64
+func hashVisitor(visitor string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(visitor))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// read a sketch from its dense registers, keeping it sparse when it can be
+func loadHyperLogLog(registers []byte) (*hyperLogLog, error) {
+	if len(registers) != 1<<hllPrecision {
+		return nil, errors.New("invalid sketch")
+	}
+	h := &hyperLogLog{}
+	for i, r := range registers {
+		if r > 0 {
+			h.set(i, r)
+		}
+	}
+	return h, nil
+}
+
+func (h *hyperLogLog) add(hash uint64) {
+	idx := hash >> (64 - hllPrecision)
+	// the rank is the position of the first set bit in what is left of the hash,
+	// at most 64-hllPrecision+1 so it fits the 6 bits of a sparse entry
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	h.set(int(idx), rank)
+}
+
+// raise register idx to rank
+func (h *hyperLogLog) set(idx int, rank uint8) {
+	if h.registers != nil {
+		if rank > h.registers[idx] {
+			h.registers[idx] = rank
+		}
+		return
+	}
+	for i, e := range h.sparse {
+		if int(e>>6) == idx {
+			if rank > uint8(e&63) {
+				h.sparse[i] = uint16(idx)<<6 | uint16(rank)
+			}
+			return
+		}
+	}
+	if len(h.sparse) < hllSparseMax {
+		h.sparse = append(h.sparse, uint16(idx)<<6|uint16(rank))
+		return
+	}
+	h.densify()
+	h.registers[idx] = rank
+}
+
+func (h *hyperLogLog) densify() {
+	h.registers = make([]uint8, 1<<hllPrecision)
+	for _, e := range h.sparse {
+		h.registers[e>>6] = uint8(e & 63)
+	}
+	h.sparse = nil
+}
+
+// call fn with every register that is set
+func (h *hyperLogLog) each(fn func(idx int, rank uint8)) {
+	for _, e := range h.sparse {
+		fn(int(e>>6), uint8(e&63))
+	}
+	for i, r := range h.registers {
+		if r > 0 {
+			fn(i, r)
+		}
+	}
+}
+
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	if other.registers != nil && h.registers == nil {
+		h.densify()
+	}
+	other.each(h.set)
+}
+
+func (h *hyperLogLog) clone() *hyperLogLog {
+	return &hyperLogLog{sparse: append([]uint16(nil), h.sparse...), registers: append([]uint8(nil), h.registers...)}
+}
+
+// every register, the form the sketch is saved in
+func (h *hyperLogLog) dense() []byte {
+	out := make([]byte, 1<<hllPrecision)
+	h.each(func(idx int, rank uint8) { out[idx] = rank })
+	return out
+}
+
+// bytes the sketch holds, without the struct itself
+func (h *hyperLogLog) size() int {
+	return 2*cap(h.sparse) + cap(h.registers)
+}
+
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(1 << hllPrecision)
+	var sum float64
+	zeros := 1 << hllPrecision
+	h.each(func(_ int, rank uint8) {
+		sum += math.Ldexp(1, -int(rank))
+		zeros--
+	})
+	sum += float64(zeros) // every zero register adds 2^-0
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// small range correction (linear counting)
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// unique visitors of a page: one sketch for the lifetime and one per hour for the last day.
+// hourly sketches are only allocated when the hour gets a visitor, and stay sparse
+// while it has few
+type uniqueSketches struct {
+	mu       sync.Mutex
+	lifetime hyperLogLog
+	slots    [24]int64
+	hours    [24]*hyperLogLog
+}
+
+func (u *uniqueSketches) add(now time.Time, visitor string) {
+	hash := hashVisitor(visitor)
+	slot := now.Unix() / int64(time.Hour/time.Second)
+	i := slot % int64(len(u.hours))
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lifetime.add(hash)
+	if u.hours[i] == nil || u.slots[i] != slot {
+		u.hours[i] = &hyperLogLog{}
+		u.slots[i] = slot
+	}
+	u.hours[i].add(hash)
+}
+
+// merge the hourly sketches covering the last d (rounded up to whole hours)
+func (u *uniqueSketches) window(now time.Time, d time.Duration) (uint64, error) {
+	if d > maxWindow {
+		return 0, fmt.Errorf("window %s is longer than %s", d, maxWindow)
+	}
+	n := int64((d + time.Hour - 1) / time.Hour)
+	slot := now.Unix() / int64(time.Hour/time.Second)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var merged hyperLogLog
+	for k := int64(0); k < n; k++ {
+		i := (slot - k) % int64(len(u.hours))
+		if u.hours[i] != nil && u.slots[i] == slot-k {
+			merged.merge(u.hours[i])
+		}
+	}
+	return merged.estimate(), nil
+}
+
+func (u *uniqueSketches) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lifetime = hyperLogLog{}
+	u.hours = [24]*hyperLogLog{}
+}
+
+// union of the visitors of both sketches, hour by hour
+func (u *uniqueSketches) merge(other *uniqueSketches) {
+	other.mu.Lock()
+	lifetime := other.lifetime.clone()
+	slots := other.slots
+	var hours [24]*hyperLogLog
+	for i, h := range other.hours {
+		if h != nil {
+			hours[i] = h.clone()
+		}
+	}
+	other.mu.Unlock()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lifetime.merge(lifetime)
+	for i, h := range hours {
+		switch {
+		case h == nil:
+		case u.hours[i] != nil && u.slots[i] == slots[i]:
+			u.hours[i].merge(h)
+		case u.hours[i] == nil || slots[i] > u.slots[i]:
+			u.hours[i] = h
+			u.slots[i] = slots[i]
+		}
+	}
+}
+
+// bytes of the sketches, the structs of the lifetime one and of the hour
+// pointers are part of pageBaseSize
+func (u *uniqueSketches) size() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n := u.lifetime.size()
+	for _, h := range u.hours {
+		if h != nil {
+			n += hllStructSize + h.size()
+		}
+	}
+	return n
+}
+
+func (u *uniqueSketches) total() uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lifetime.estimate()
+}
+
+// a page with its count, what TOP answers with
+type rankedPage struct {
+	Name string
+	Hits uint64
+}
+
+// min-heap on hits, keeps the k biggest pages seen so far with the smallest on top
+type rankHeap []rankedPage
+
+func (h rankHeap) Len() int           { return len(h) }
+func (h rankHeap) Less(i, j int) bool { return h[i].Hits < h[j].Hits }
+func (h rankHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *rankHeap) Push(x any)        { *h = append(*h, x.(rankedPage)) }
+func (h *rankHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// offer a page to a heap holding at most k pages
+func (h *rankHeap) offer(p rankedPage, k int) {
+	if h.Len() < k {
+		heap.Push(h, p)
+		return
+	}
+	if p.Hits > (*h)[0].Hits {
+		(*h)[0] = p
+		heap.Fix(h, 0)
+	}
+}
+
+// the pages of the heap from the most to the least visited
+func (h rankHeap) sorted() []rankedPage {
+	out := []rankedPage(h)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hits != out[j].Hits {
+			return out[i].Hits > out[j].Hits
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// how many pages each Space-Saving summary tracks, also the biggest k TOP accepts with a window
+const topCapacity = 128
+
+// entry of a Space-Saving summary, count may over estimate the real hits by at most err
+type ssEntry struct {
+	key   string
+	count uint64
+	err   uint64
+	index int // position in the heap
+}
+
+// min-heap of the entries so the smallest counter can be replaced in O(log n)
+type ssHeap []*ssEntry
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *ssHeap) Push(x any) {
+	e := x.(*ssEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *ssHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Space-Saving heavy hitter summary: tracks at most capacity pages, a new page
+// takes over the counter of the smallest one so the real heavy hitters always stay
+type spaceSaving struct {
+	capacity int
+	entries  map[string]*ssEntry
+	heap     ssHeap
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, entries: make(map[string]*ssEntry)}
+}
+
+func (s *spaceSaving) add(key string, n uint64) {
+	if e, ok := s.entries[key]; ok {
+		e.count += n
+		heap.Fix(&s.heap, e.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		e := &ssEntry{key: key, count: n}
+		s.entries[key] = e
+		heap.Push(&s.heap, e)
+		return
+	}
+	// evict the smallest counter and inherit its count as the error
+	e := s.heap[0]
+	delete(s.entries, e.key)
+	e.key = key
+	e.err = e.count
+	e.count += n
+	s.entries[key] = e
+	heap.Fix(&s.heap, 0)
+}
+
+// ring of summaries, one per bucket of time like bucketRing
+type topRing struct {
+	width time.Duration
+	slots []int64
+	sums  []*spaceSaving
+}
+
+func newTopRing(width time.Duration, size int) *topRing {
+	return &topRing{width: width, slots: make([]int64, size), sums: make([]*spaceSaving, size)}
+}
+
+func (r *topRing) span() time.Duration {
+	return r.width * time.Duration(len(r.sums))
+}
+
+func (r *topRing) add(now time.Time, key string, n uint64) {
+	slot := now.UnixNano() / int64(r.width)
+	i := slot % int64(len(r.sums))
+	if r.sums[i] == nil || r.slots[i] != slot {
+		r.sums[i] = newSpaceSaving(topCapacity)
+		r.slots[i] = slot
+	}
+	r.sums[i].add(key, n)
+}
+
+// add up the summaries of the buckets covering the last d
+func (r *topRing) merge(now time.Time, d time.Duration, into map[string]uint64) {
+	n := int64((d + r.width - 1) / r.width)
+	if n > int64(len(r.sums)) {
+		n = int64(len(r.sums))
+	}
+	slot := now.UnixNano() / int64(r.width)
+	for k := int64(0); k < n; k++ {
+		i := (slot - k) % int64(len(r.sums))
+		if r.sums[i] == nil || r.slots[i] != slot-k {
+			continue
+		}
+		for key, e := range r.sums[i].entries {
+			into[key] += e.count
+		}
+	}
+}
+
+// heavy hitters of the recent windows with the same resolutions as hitWindows.
+// memory is bounded by (60+60+24) * topCapacity entries whatever the number of pages
+// (per stripe, see topStripes)
+type topTracker struct {
+	mu    sync.Mutex
+	rings []*topRing
+}
+
+func newTopTracker() *topTracker {
+	return &topTracker{
+		rings: []*topRing{
+			newTopRing(time.Second, 60),
+			newTopRing(time.Minute, 60),
+			newTopRing(time.Hour, 24),
+		},
+	}
+}
+
+func (t *topTracker) add(now time.Time, key string, n uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.rings {
+		r.add(now, key, n)
+	}
+}
+
+// add the summaries of the last d to into using the finest ring that covers it
+func (t *topTracker) merge(now time.Time, d time.Duration, into map[string]uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.rings {
+		if d <= r.span() {
+			r.merge(now, d, into)
+			return nil
+		}
+	}
+	return fmt.Errorf("window %s is longer than %s", d, maxWindow)
+}
+
+// number of independent trackers. each one can hold (60+60+24) * topCapacity
+// entries, so there are fewer stripes than page shards: with many cores the
+// hits still queue on these locks, but the memory stays a few MB
+const topStripeCount = 8
+
+// the heavy hitter tracker split by page hash. a page always goes to the same stripe
+// so the stripes hold disjoint pages and merging them loses nothing
+type topStripes struct {
+	stripes [topStripeCount]*topTracker
+}
+
+func newTopStripes() *topStripes {
+	t := &topStripes{}
+	for i := range t.stripes {
+		t.stripes[i] = newTopTracker()
+	}
+	return t
+}
+
+func (t *topStripes) add(now time.Time, hash uint64, key string, n uint64) {
+	t.stripes[hash%topStripeCount].add(now, key, n)
+}
+
+// approximate k most visited pages of the last d, the counts are upper bounds
+func (t *topStripes) top(now time.Time, d time.Duration, k int) ([]rankedPage, error) {
+	merged := make(map[string]uint64)
+	for _, stripe := range t.stripes {
+		if err := stripe.merge(now, d, merged); err != nil {
+			return nil, err
+		}
+	}
+
+	var h rankHeap
+	for key, count := range merged {
+		h.offer(rankedPage{Name: key, Hits: count}, k)
+	}
+	return h.sorted(), nil
+}
+
+// limits that keep the tag counters of a page bounded whatever the clients send
+const (
+	maxDimensions       = 16  // different tag keys per page, extra keys are dropped
+	maxValuesPerDim     = 100 // different values per key, extra values are counted under otherTagValue
+	maxTagKeyLength     = 32
+	maxTagValueLength   = 128
+	otherTagValue       = "(other)"
+	droppedDimensionKey = "(dropped)" // counts the tags whose key didn't fit in maxDimensions
+)
+
+// hits of a page broken down by tag, like ref=google.com or country=et
+type tagCounts struct {
+	mu   sync.Mutex
+	dims map[string]map[string]uint64
+}
+
+func (t *tagCounts) add(tags map[string]string, n uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dims == nil {
+		t.dims = make(map[string]map[string]uint64)
+	}
+	for key, value := range tags {
+		values, ok := t.dims[key]
+		if !ok {
+			// the overflow dimension doesn't take the place of a real one, so a merge
+			// that meets it first keeps the same keys as the hits did
+			limit := maxDimensions
+			if _, ok := t.dims[droppedDimensionKey]; ok && key != droppedDimensionKey {
+				limit++
+			}
+			if len(t.dims) >= limit && key != droppedDimensionKey {
+				key, value = droppedDimensionKey, key
+				if values, ok = t.dims[key]; !ok {
+					values = make(map[string]uint64)
+					t.dims[key] = values
+				}
+			} else {
+				values = make(map[string]uint64)
+				t.dims[key] = values
+			}
+		}
+		limit := maxValuesPerDim
+		if _, ok := values[otherTagValue]; ok {
+			limit++
+		}
+		if _, seen := values[value]; !seen && value != otherTagValue && len(values) >= limit {
+			value = otherTagValue
+		}
+		values[value] += n
+	}
+}
+
+func (t *tagCounts) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dims = nil
+}
+
+// add the counts of other into t, within the same limits as new hits
+func (t *tagCounts) merge(other *tagCounts) {
+	other.mu.Lock()
+	var adds []map[string]string
+	var counts []uint64
+	for key, values := range other.dims {
+		for value, n := range values {
+			adds = append(adds, map[string]string{key: value})
+			counts = append(counts, n)
+		}
+	}
+	other.mu.Unlock()
+
+	for i, tags := range adds {
+		t.add(tags, counts[i])
+	}
+}
+
+// bytes of the dimensions and their values
+func (t *tagCounts) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for key, values := range t.dims {
+		n += mapEntrySize + len(key)
+		for value := range values {
+			n += mapEntrySize + len(value)
+		}
+	}
+	return n
+}
+
+// counts of one dimension from the most to the least common value
+func (t *tagCounts) breakdown(key string) ([]rankedPage, bool) {
+	t.mu.Lock()
+	values, ok := t.dims[key]
+	out := make([]rankedPage, 0, len(values))
+	for value, count := range values {
+		out = append(out, rankedPage{Name: value, Hits: count})
+	}
+	t.mu.Unlock()
+	return rankHeap(out).sorted(), ok
+}
+
+// parse key=value tokens, keys are lower cased and both sides are cut to their max length
+func parseTags(tokens []string) (map[string]string, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		key, value, ok := strings.Cut(token, "=")
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid tag %s", token)
+		}
+		tags[truncate(strings.ToLower(key), maxTagKeyLength)] = truncate(value, maxTagValueLength)
+	}
+	return tags, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// the lifetime total of a page is a G-counter CRDT: every node only increments its own
+// entry and entries are merged by taking the max, so all nodes converge to the same
+// sum whatever the order the updates arrive in
 type PageHit struct {
 	Name string
-	// atomic counter with thread-safety without requiring exlicit locking without causing race conditions
+	// atomic counter with thread-safety without requiring exlicit locking without causing race conditions.
+	// this is the entry of this node in the G-counter
 	hit atomic.Uint64
+	// entries of the other nodes, learned through gossip
+	replicaMu sync.Mutex
+	epoch     uint64 // bumped by admin changes, a higher epoch replaces the whole G-counter
+	replicas  map[string]uint64
+	remote    atomic.Uint64 // sum of replicas so total() doesn't need the lock
+	// recent hits for windowed queries, the lifetime total stays in hit
+	windows *hitWindows
+	// estimated unique visitors
+	uniques *uniqueSketches
+	// lifetime hits per tag value
+	tags tagCounts
+	// hits dropped by the abuse protection, not part of hit
+	filtered atomic.Uint64
+	// when and how often the page was used, to pick the cold pages to evict
+	lastUsed atomic.Int64
+	uses     atomic.Uint64
+}
+
+func newPageHit(name string) *PageHit {
+	return &PageHit{Name: name, windows: newHitWindows(), uniques: &uniqueSketches{}}
+}
+
+// record n hits from a visitor for the page in the lifetime total, the windows,
+// the unique sketches and the tag counters
+func (p *PageHit) record(n uint64, visitor string, tags map[string]string) uint64 {
+	now := time.Now()
+	p.windows.add(now, n)
+	p.uniques.add(now, visitor)
+	if len(tags) > 0 {
+		p.tags.add(tags, n)
+	}
+	return p.hit.Add(n) + p.remote.Load()
+}
+
+// converged lifetime total of every node
+func (p *PageHit) total() uint64 {
+	return p.hit.Load() + p.remote.Load()
+}
+
+// epoch of the G-counter with the total in it
+func (p *PageHit) epochTotal() (uint64, uint64) {
+	p.replicaMu.Lock()
+	defer p.replicaMu.Unlock()
+	return p.epoch, p.total()
+}
+
+// epoch and entries of the G-counter, this node included
+func (p *PageHit) counters(self string) (uint64, map[string]uint64) {
+	p.replicaMu.Lock()
+	defer p.replicaMu.Unlock()
+	out := make(map[string]uint64, len(p.replicas)+1)
+	for node, n := range p.replicas {
+		out[node] = n
+	}
+	out[self] = p.hit.Load()
+	return p.epoch, out
+}
+
+// merge G-counter entries from a peer, keeping the max of every entry. our own entry
+// is raised too, which gives back our count if we restarted and a peer still knows it.
+// entries of an older epoch are ignored, a newer epoch (an admin change made on the
+// peer) replaces our state
+func (p *PageHit) mergeCounters(self string, epoch uint64, counters map[string]uint64) {
+	p.replicaMu.Lock()
+	defer p.replicaMu.Unlock()
+	if epoch < p.epoch {
+		return
+	}
+	if epoch > p.epoch {
+		p.epoch = epoch
+		p.replicas = nil
+		p.hit.Store(counters[self])
+		p.clearLocal()
+	}
+
+	for {
+		local := p.hit.Load()
+		if counters[self] <= local || p.hit.CompareAndSwap(local, counters[self]) {
+			break
+		}
+	}
+
+	if p.replicas == nil {
+		p.replicas = make(map[string]uint64)
+	}
+	var sum uint64
+	for node, n := range counters {
+		if node != self && n > p.replicas[node] {
+			p.replicas[node] = n
+		}
+	}
+	for _, n := range p.replicas {
+		sum += n
+	}
+	p.remote.Store(sum)
+}
+
+// start a new epoch where this node holds the whole total n, the entries of
+// the other nodes are dropped here and on every peer once they gossip with us
+func (p *PageHit) resetTo(n uint64) {
+	p.replicaMu.Lock()
+	defer p.replicaMu.Unlock()
+	p.epoch++
+	p.replicas = nil
+	p.remote.Store(0)
+	p.hit.Store(n)
+}
+
+// clear what only this node knows about the page
+func (p *PageHit) clearLocal() {
+	p.windows.reset()
+	p.uniques.reset()
+	p.tags.reset()
+	p.filtered.Store(0)
+}
+
+// move every count of other into p, used to merge a renamed page
+func (p *PageHit) absorb(other *PageHit) {
+	p.resetTo(p.total() + other.total())
+	p.windows.merge(other.windows)
+	p.uniques.merge(other.uniques)
+	p.tags.merge(&other.tags)
+	p.filtered.Add(other.filtered.Load())
+}
+
+func (p *PageHit) touch() {
+	p.lastUsed.Store(time.Now().UnixNano())
+	p.uses.Add(1)
+}
+
+// rough overhead of a map entry, used to estimate the memory of maps
+const mapEntrySize = 48
+
+// bytes of a sketch struct with its two slice headers
+const hllStructSize = 48
+
+// bytes every page takes: the struct with its name as the map key, the
+// buckets of the windows and the pointers to the hourly sketches. the
+// registers of the sketches are counted by uniqueSketches.size
+const pageBaseSize = 256 + (60+60+24)*16 + 24*16
+
+// estimated bytes the page holds in memory, for the memory budget
+func (p *PageHit) size() int64 {
+	n := pageBaseSize + 2*len(p.Name)
+	p.replicaMu.Lock()
+	for node := range p.replicas {
+		n += mapEntrySize + len(node)
+	}
+	p.replicaMu.Unlock()
+	return int64(n + p.uniques.size() + p.tags.size())
+}
+
+// hits in the last d
+func (p *PageHit) windowHits(d time.Duration) (uint64, error) {
+	return p.windows.sum(time.Now(), d)
+}
+
+// hits per second over the last minute
+func (p *PageHit) rate() float64 {
+	n, _ := p.windowHits(time.Minute)
+	return float64(n) / time.Minute.Seconds()
+}
+
+// number of shards of the page map, a power of two
+const shardCount = 64
+
+// one part of the page map with its own lock. hits on pages that already exist
+// only take the read lock so they never wait on each other
+type pageShard struct {
+	mu      sync.RWMutex
+	pages   map[string]*PageHit
+	tombs   map[string]uint64       // epoch of deleted pages, so gossip from peers doesn't bring them back
+	evicted map[string]*evictedPage // pages on disk, so the listings and gossip don't read the files
+	index   []scanEntry             // every page, in memory or on disk, sorted for SCAN
+}
+
+// a page in the SCAN order of its shard: by the high half of its hash, which
+// stays the same while the server runs, so a cursor survives pages coming and going
+type scanEntry struct {
+	key  uint32
+	name string
+}
+
+func scanKey(hash uint64) uint32 {
+	return uint32(hash >> 32)
+}
+
+// position of name in the index, or where it goes. the shard lock must be held
+func (sh *pageShard) indexOf(key uint32, name string) (int, bool) {
+	i := sort.Search(len(sh.index), func(i int) bool {
+		e := sh.index[i]
+		return e.key > key || e.key == key && e.name >= name
+	})
+	return i, i < len(sh.index) && sh.index[i].name == name
+}
+
+// the shard write lock must be held
+func (sh *pageShard) indexAdd(key uint32, name string) {
+	i, found := sh.indexOf(key, name)
+	if found {
+		return
+	}
+	sh.index = append(sh.index, scanEntry{})
+	copy(sh.index[i+1:], sh.index[i:])
+	sh.index[i] = scanEntry{key: key, name: name}
+}
+
+// the shard write lock must be held
+func (sh *pageShard) indexRemove(key uint32, name string) {
+	if i, found := sh.indexOf(key, name); found {
+		sh.index = append(sh.index[:i], sh.index[i+1:]...)
+	}
+}
+
+// what stays in memory of an evicted page: its G-counter and the numbers of the
+// listings. an evicted page gets no hits, so they only change when gossip merges
+// into its file, which replaces the entry. entries are never changed in place
+type evictedPage struct {
+	epoch    uint64
+	hit      uint64
+	replicas map[string]uint64
+	filtered uint64
+	uniques  uint64
+	windows  [][]spilledBucket // the buckets with hits, per ring of windowResolutions
+}
+
+func newEvictedPage(snap pageSnapshot) *evictedPage {
+	e := &evictedPage{epoch: snap.Epoch, hit: snap.Hit, replicas: snap.Replicas, filtered: snap.Filtered, windows: snap.Windows}
+	if lifetime, err := loadHyperLogLog(snap.Lifetime); err == nil {
+		e.uniques = lifetime.estimate()
+	}
+	return e
+}
+
+func (e *evictedPage) total() uint64 {
+	n := e.hit
+	for _, r := range e.replicas {
+		n += r
+	}
+	return n
+}
+
+// epoch and entries of the G-counter like PageHit.counters
+func (e *evictedPage) counters(self string) (uint64, map[string]uint64) {
+	out := make(map[string]uint64, len(e.replicas)+1)
+	for node, n := range e.replicas {
+		out[node] = n
+	}
+	out[self] = e.hit
+	return e.epoch, out
+}
+
+// true if merging the entries of a peer would change the page, see PageHit.mergeCounters
+func (e *evictedPage) changedBy(self string, epoch uint64, counters map[string]uint64) bool {
+	if epoch != e.epoch {
+		return epoch > e.epoch
+	}
+	for node, n := range counters {
+		if node == self && n > e.hit || node != self && n > e.replicas[node] {
+			return true
+		}
+	}
+	return false
+}
+
+// hits of the last d, like hitWindows.sum on the buckets that were written to disk
+func (e *evictedPage) windowHits(now time.Time, d time.Duration) uint64 {
+	for i, res := range windowResolutions {
+		if d > res.width*time.Duration(res.size) {
+			continue
+		}
+		n := int64((d + res.width - 1) / res.width)
+		slot := now.UnixNano() / int64(res.width)
+		var total uint64
+		if i < len(e.windows) {
+			for _, b := range e.windows[i] {
+				if b.Slot <= slot && b.Slot > slot-n {
+					total += b.Count
+				}
+			}
+		}
+		return total
+	}
+	return 0
+}
+
+func (e *evictedPage) stats(name string, now time.Time) pageStatsJSON {
+	return pageStatsJSON{
+		Page:       name,
+		Hits:       e.total(),
+		LastMinute: e.windowHits(now, time.Minute),
+		LastHour:   e.windowHits(now, time.Hour),
+		LastDay:    e.windowHits(now, 24*time.Hour),
+		Uniques:    e.uniques,
+		Filtered:   e.filtered,
+	}
+}
+
+// page map split in shards by the hash of the page name, so clients hitting
+// different pages don't serialize on a single lock
+type pageStore struct {
+	seed   maphash.Seed
+	shards [shardCount]pageShard
+
+	spill     *spillStore // cold pages evicted to disk, nil when there is no memory budget
+	evictions atomic.Uint64
+	reloads   atomic.Uint64
+}
+
+func newPageStore() *pageStore {
+	s := &pageStore{seed: maphash.MakeSeed()}
+	for i := range s.shards {
+		s.shards[i].pages = make(map[string]*PageHit)
+		s.shards[i].tombs = make(map[string]uint64)
+		s.shards[i].evicted = make(map[string]*evictedPage)
+	}
+	return s
+}
+
+func (s *pageStore) hash(name string) uint64 {
+	return maphash.String(s.seed, name)
+}
+
+func (s *pageStore) shard(hash uint64) *pageShard {
+	return &s.shards[hash&(shardCount-1)]
+}
+
+// find a page, bringing it back from disk if it was evicted
+func (s *pageStore) get(name string) (*PageHit, bool) {
+	sh := s.shard(s.hash(name))
+	sh.mu.RLock()
+	pg, exists := sh.pages[name]
+	sh.mu.RUnlock()
+	if !exists && s.spill != nil {
+		sh.mu.Lock()
+		if pg, exists = sh.pages[name]; !exists {
+			pg, exists = s.reload(sh, name)
+		}
+		sh.mu.Unlock()
+	}
+	if exists {
+		pg.touch()
+	}
+	return pg, exists
+}
+
+// find a page for a read only look, like the alert rules: an evicted page is read
+// from disk but stays there, and the page doesn't count as used, so reading it
+// doesn't undo the lru or lfu ranking. the result must only be read
+func (s *pageStore) peek(name string) (*PageHit, bool) {
+	sh := s.shard(s.hash(name))
+	sh.mu.RLock()
+	pg, exists := sh.pages[name]
+	_, evicted := sh.evicted[name]
+	sh.mu.RUnlock()
+	if exists || !evicted {
+		return pg, exists
+	}
+	pg, exists, err := s.spill.read(name)
+	if err != nil {
+		fmt.Println("Spill error:", err)
+	}
+	return pg, exists
+}
+
+// run fn on the page, creating it or bringing it back from disk if needed.
+// fn runs under the shard read lock so the page can't be evicted while fn
+// changes it, fn must not use the store
+func (s *pageStore) update(hash uint64, name string, fn func(*PageHit)) *PageHit {
+	sh := s.shard(hash)
+	for {
+		sh.mu.RLock()
+		pg, exists := sh.pages[name]
+		if exists {
+			fn(pg)
+		}
+		sh.mu.RUnlock()
+		if exists {
+			return pg
+		}
+		// the page may be evicted again before we take the read lock, so check again
+		s.getOrCreate(hash, name)
+	}
+}
+
+// like update, but only for a page that exists in memory or on disk. nothing is
+// created for an unknown page, fn doesn't run and the result is nil
+func (s *pageStore) updateExisting(hash uint64, name string, fn func(*PageHit)) *PageHit {
+	sh := s.shard(hash)
+	for {
+		sh.mu.RLock()
+		pg, exists := sh.pages[name]
+		if exists {
+			fn(pg)
+		}
+		sh.mu.RUnlock()
+		if exists {
+			return pg
+		}
+		if s.spill == nil {
+			return nil
+		}
+		sh.mu.Lock()
+		if _, exists = sh.pages[name]; !exists {
+			_, exists = s.reload(sh, name)
+		}
+		sh.mu.Unlock()
+		if !exists {
+			return nil
+		}
+	}
+}
+
+// move an evicted page back into its shard, the shard write lock must be held.
+// a reload counts as a use so pages don't go back and forth on every sweep
+func (s *pageStore) reload(sh *pageShard, name string) (*PageHit, bool) {
+	if s.spill == nil {
+		return nil, false
+	}
+	if _, evicted := sh.evicted[name]; !evicted {
+		return nil, false
+	}
+	pg, ok, err := s.spill.load(name)
+	if err != nil {
+		fmt.Println("Spill error:", err)
+	}
+	if !ok {
+		return nil, false
+	}
+	delete(sh.evicted, name)
+	pg.touch()
+	sh.pages[name] = pg
+	s.reloads.Add(1)
+	return pg, true
+}
+
+// write pg to disk and drop it from memory, false if it is not in the store
+// anymore or couldn't be written. the shard lock is held while writing so a
+// hit can't create a fresh page in between
+func (s *pageStore) evict(pg *PageHit) bool {
+	sh := s.shard(s.hash(pg.Name))
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.pages[pg.Name] != pg {
+		return false
+	}
+	snap := pg.snapshot()
+	if err := s.spill.save(snap); err != nil {
+		fmt.Println("Spill error:", err)
+		return false
+	}
+	delete(sh.pages, pg.Name)
+	sh.evicted[pg.Name] = newEvictedPage(snap)
+	s.evictions.Add(1)
+	return true
+}
+
+// merge G-counter entries from a peer into a page, creating it if needed, and
+// tell if its total changed. an evicted page is merged into its file when the
+// entries change it and left alone when they don't, so gossip never brings the
+// cold pages back into memory
+func (s *pageStore) mergeCounters(name, self string, epoch uint64, counters map[string]uint64) bool {
+	hash := s.hash(name)
+	sh := s.shard(hash)
+	sh.mu.RLock()
+	_, evicted := sh.evicted[name]
+	sh.mu.RUnlock()
+	if evicted {
+		if changed, ok := s.mergeEvicted(sh, name, self, epoch, counters); ok {
+			return changed
+		}
+	}
+
+	var changed bool
+	s.update(hash, name, func(pg *PageHit) {
+		before := pg.total()
+		pg.mergeCounters(self, epoch, counters)
+		changed = pg.total() != before
+	})
+	return changed
+}
+
+// merge into the file of an evicted page, false if the page isn't evicted anymore
+func (s *pageStore) mergeEvicted(sh *pageShard, name, self string, epoch uint64, counters map[string]uint64) (changed, ok bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e, evicted := sh.evicted[name]
+	if !evicted {
+		return false, false
+	}
+	if !e.changedBy(self, epoch, counters) {
+		return false, true
+	}
+	pg, found, err := s.spill.read(name)
+	if found {
+		pg.mergeCounters(self, epoch, counters)
+		snap := pg.snapshot()
+		if err = s.spill.write(snap); err == nil {
+			sh.evicted[name] = newEvictedPage(snap)
+			return pg.total() != e.total(), true
+		}
+	}
+	if err != nil {
+		fmt.Println("Spill error:", err)
+	}
+	return false, true
+}
+
+func (s *pageStore) getOrCreate(hash uint64, name string) *PageHit {
+	sh := s.shard(hash)
+
+	// fast path, the page already exists
+	sh.mu.RLock()
+	pg, exists := sh.pages[name]
+	sh.mu.RUnlock()
+	if exists {
+		return pg
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	// another client may have created it between the two locks
+	if pg, exists := sh.pages[name]; exists {
+		return pg
+	}
+	if pg, exists := s.reload(sh, name); exists {
+		return pg
+	}
+	pg = newPageHit(name)
+	// a page hit again after a delete starts in an epoch newer than its tombstone
+	if epoch, deleted := sh.tombs[name]; deleted {
+		pg.epoch = epoch + 1
+		delete(sh.tombs, name)
+	}
+	sh.pages[name] = pg
+	sh.indexAdd(scanKey(hash), name)
+	return pg
+}
+
+// delete a page and leave a tombstone with its epoch, false if it didn't exist
+func (s *pageStore) remove(name string) (*PageHit, bool) {
+	sh := s.shard(s.hash(name))
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	pg, exists := sh.pages[name]
+	if !exists {
+		if pg, exists = s.reload(sh, name); !exists {
+			return nil, false
+		}
+	}
+	delete(sh.pages, name)
+	sh.indexRemove(scanKey(s.hash(name)), name)
+	pg.replicaMu.Lock()
+	sh.tombs[name] = pg.epoch + 1
+	pg.replicaMu.Unlock()
+	return pg, true
+}
+
+// put a page read back from the state file in the store, replacing what is there
+func (s *pageStore) restore(pg *PageHit) {
+	hash := s.hash(pg.Name)
+	sh := s.shard(hash)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.pages[pg.Name] = pg
+	sh.indexAdd(scanKey(hash), pg.Name)
+	delete(sh.tombs, pg.Name)
+}
+
+// put a tombstone read back from the state file in the store
+func (s *pageStore) restoreTomb(name string, epoch uint64) {
+	sh := s.shard(s.hash(name))
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, exists := sh.pages[name]; !exists && epoch > sh.tombs[name] {
+		sh.tombs[name] = epoch
+	}
+}
+
+// apply a tombstone learned from a peer: drop the page if it is not newer than it
+func (s *pageStore) bury(name string, epoch uint64) {
+	sh := s.shard(s.hash(name))
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	pg, exists := sh.pages[name]
+	if !exists {
+		pg, exists = s.reload(sh, name)
+	}
+	if exists {
+		pg.replicaMu.Lock()
+		newer := pg.epoch >= epoch
+		pg.replicaMu.Unlock()
+		if newer {
+			return
+		}
+		delete(sh.pages, name)
+		sh.indexRemove(scanKey(s.hash(name)), name)
+	}
+	if epoch > sh.tombs[name] {
+		sh.tombs[name] = epoch
+	}
+}
+
+// true if the page was deleted in epoch or later
+func (s *pageStore) buried(name string, epoch uint64) bool {
+	sh := s.shard(s.hash(name))
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	tomb, deleted := sh.tombs[name]
+	return deleted && tomb >= epoch
+}
+
+// copy of every tombstone
+func (s *pageStore) tombstones() map[string]uint64 {
+	out := make(map[string]uint64)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for name, epoch := range sh.tombs {
+			out[name] = epoch
+		}
+		sh.mu.RUnlock()
+	}
+	return out
+}
+
+// call fn for every page. only one shard is copied at a time and fn runs without
+// any lock held, so a slow fn (like writing to a client) never blocks hits.
+// returning false from fn stops the walk
+func (s *pageStore) each(fn func(*PageHit) bool) {
+	var buf []*PageHit
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		buf = buf[:0]
+		for _, pg := range sh.pages {
+			buf = append(buf, pg)
+		}
+		sh.mu.RUnlock()
+
+		for _, pg := range buf {
+			if !fn(pg) {
+				return
+			}
+		}
+	}
+}
+
+// call fn for every evicted page with what is kept of it in memory, like each
+// nothing is read from disk and no lock is held while fn runs
+func (s *pageStore) eachEvicted(fn func(name string, e *evictedPage) bool) {
+	type entry struct {
+		name string
+		page *evictedPage
+	}
+	var buf []entry
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		buf = buf[:0]
+		for name, e := range sh.evicted {
+			buf = append(buf, entry{name, e})
+		}
+		sh.mu.RUnlock()
+
+		for _, e := range buf {
+			if !fn(e.name, e.page) {
+				return
+			}
+		}
+	}
+}
+
+// every page, evicted ones included
+func (s *pageStore) count() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += len(sh.index)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// up to count pages from cursor on, in the order of the shards and then of their
+// scan index, and the cursor of the next call (0 at the end). the cursor is the
+// shard in the high bits and the key to start from in the low 32 bits. pages with
+// the same key are returned together so the cursor never points between them
+func (s *pageStore) scan(cursor uint64, count int) ([]string, uint64) {
+	var names []string
+	for shard, key := cursor>>32, uint32(cursor); shard < shardCount; shard, key = shard+1, 0 {
+		if len(names) >= count {
+			return names, shard<<32 | uint64(key)
+		}
+		sh := &s.shards[shard]
+		sh.mu.RLock()
+		i, _ := sh.indexOf(key, "")
+		for ; i < len(sh.index); i++ {
+			if len(names) >= count && sh.index[i].key != sh.index[i-1].key {
+				break
+			}
+			names = append(names, sh.index[i].name)
+		}
+		var next uint64
+		if i < len(sh.index) {
+			next = shard<<32 | uint64(sh.index[i].key)
+		}
+		sh.mu.RUnlock()
+		if next != 0 {
+			return names, next
+		}
+	}
+	return names, 0
+}
+
+// pages in memory, evicted pages are not counted
+func (s *pageStore) len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += len(sh.pages)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// state of an evicted page as it is written to disk
+type pageSnapshot struct {
+	Name     string                       `json:"name"`
+	Epoch    uint64                       `json:"epoch"`
+	Hit      uint64                       `json:"hit"`
+	Replicas map[string]uint64            `json:"replicas,omitempty"`
+	Filtered uint64                       `json:"filtered,omitempty"`
+	Windows  [][]spilledBucket            `json:"windows"` // per ring, only the buckets with hits
+	Lifetime []byte                       `json:"lifetime"`
+	Hours    []spilledSketch              `json:"hours,omitempty"`
+	Tags     map[string]map[string]uint64 `json:"tags,omitempty"`
+}
+
+type spilledBucket struct {
+	Index int    `json:"i"`
+	Slot  int64  `json:"slot"`
+	Count uint64 `json:"n"`
+}
+
+type spilledSketch struct {
+	Index     int    `json:"i"`
+	Slot      int64  `json:"slot"`
+	Registers []byte `json:"registers"`
+}
+
+func (p *PageHit) snapshot() pageSnapshot {
+	snap := pageSnapshot{Name: p.Name, Filtered: p.filtered.Load()}
+
+	p.replicaMu.Lock()
+	snap.Epoch = p.epoch
+	snap.Hit = p.hit.Load()
+	if len(p.replicas) > 0 {
+		snap.Replicas = make(map[string]uint64, len(p.replicas))
+		for node, n := range p.replicas {
+			snap.Replicas[node] = n
+		}
+	}
+	p.replicaMu.Unlock()
+
+	p.windows.mu.Lock()
+	for _, r := range p.windows.rings {
+		var buckets []spilledBucket
+		for i, b := range r.buckets {
+			if b.count > 0 {
+				buckets = append(buckets, spilledBucket{Index: i, Slot: b.slot, Count: b.count})
+			}
+		}
+		snap.Windows = append(snap.Windows, buckets)
+	}
+	p.windows.mu.Unlock()
+
+	p.uniques.mu.Lock()
+	snap.Lifetime = p.uniques.lifetime.dense()
+	for i, h := range p.uniques.hours {
+		if h != nil {
+			snap.Hours = append(snap.Hours, spilledSketch{Index: i, Slot: p.uniques.slots[i], Registers: h.dense()})
+		}
+	}
+	p.uniques.mu.Unlock()
+
+	p.tags.mu.Lock()
+	if len(p.tags.dims) > 0 {
+		snap.Tags = make(map[string]map[string]uint64, len(p.tags.dims))
+		for key, values := range p.tags.dims {
+			snap.Tags[key] = make(map[string]uint64, len(values))
+			for value, n := range values {
+				snap.Tags[key][value] = n
+			}
+		}
+	}
+	p.tags.mu.Unlock()
+	return snap
+}
+
+// rebuild a page from its snapshot, checking that every index fits
+func pageFromSnapshot(snap pageSnapshot) (*PageHit, error) {
+	pg := newPageHit(snap.Name)
+	pg.epoch = snap.Epoch
+	pg.hit.Store(snap.Hit)
+	pg.filtered.Store(snap.Filtered)
+	if len(snap.Replicas) > 0 {
+		pg.replicas = snap.Replicas
+		var sum uint64
+		for _, n := range snap.Replicas {
+			sum += n
+		}
+		pg.remote.Store(sum)
+	}
+
+	if len(snap.Windows) > len(pg.windows.rings) {
+		return nil, errors.New("too many windows")
+	}
+	for i, buckets := range snap.Windows {
+		r := pg.windows.rings[i]
+		for _, b := range buckets {
+			if b.Index < 0 || b.Index >= len(r.buckets) {
+				return nil, fmt.Errorf("bucket %d out of range", b.Index)
+			}
+			r.buckets[b.Index] = bucket{slot: b.Slot, count: b.Count}
+		}
+	}
+
+	lifetime, err := loadHyperLogLog(snap.Lifetime)
+	if err != nil {
+		return nil, errors.New("invalid lifetime sketch")
+	}
+	pg.uniques.lifetime = *lifetime
+	for _, h := range snap.Hours {
+		sketch, err := loadHyperLogLog(h.Registers)
+		if h.Index < 0 || h.Index >= len(pg.uniques.hours) || err != nil {
+			return nil, fmt.Errorf("invalid hourly sketch %d", h.Index)
+		}
+		pg.uniques.hours[h.Index] = sketch
+		pg.uniques.slots[h.Index] = h.Slot
+	}
+
+	pg.tags.dims = snap.Tags
+	return pg, nil
+}
+
+// evicted pages on disk, one json file per page under dir/<xx>/<hash>.page.
+// the files only live until the page is hit again or the server stops, so
+// a restart starts without them like it starts without the pages in memory
+type spillStore struct {
+	dir   string
+	pages atomic.Int64 // pages currently on disk
+}
+
+// use dir for the evicted pages, removing the ones left by a previous run
+func openSpillStore(dir string) (*spillStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*", "*.page"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return &spillStore{dir: dir}, nil
+}
+
+// page names can be anything so the file is named after their hash
+func (s *spillStore) path(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	h := hex.EncodeToString(sum[:16])
+	return filepath.Join(s.dir, h[:2], h+".page")
+}
+
+func (s *spillStore) save(snap pageSnapshot) error {
+	if err := s.write(snap); err != nil {
+		return err
+	}
+	s.pages.Add(1)
+	return nil
+}
+
+// write the file of a page, replacing the one that may be there
+func (s *spillStore) write(snap pageSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	path := s.path(snap.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// read a copy of an evicted page, leaving it on disk. false if it is not on disk
+func (s *spillStore) read(name string) (*PageHit, bool, error) {
+	path := s.path(name)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var snap pageSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, false, fmt.Errorf("%s: %v", path, err)
+	}
+	if snap.Name != name {
+		return nil, false, fmt.Errorf("%s holds %s, not %s", path, snap.Name, name)
+	}
+	pg, err := pageFromSnapshot(snap)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", path, err)
+	}
+	return pg, true, nil
+}
+
+// read an evicted page back and delete its file, false if it is not on disk
+func (s *spillStore) load(name string) (*PageHit, bool, error) {
+	pg, ok, err := s.read(name)
+	if !ok {
+		return nil, false, err
+	}
+	if err := os.Remove(s.path(name)); err != nil {
+		return nil, false, err
+	}
+	s.pages.Add(-1)
+	return pg, true, nil
+}
+
+// how often the evictor measures the pages against the memory budget
+const evictInterval = time.Second
+
+// measure the pages every evictInterval and evict the cold ones when they don't fit
+func (hcs *HitCounterServer) runEvictor(ctx context.Context) {
+	defer hcs.wg.Done()
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hcs.evictCold()
+		}
+	}
+}
+
+// spill the coldest pages to disk until the rest fits in 90% of the budget,
+// so the evictor doesn't run again after a few more hits. cold is the least
+// recently used page for lru and the least used one for lfu
+func (hcs *HitCounterServer) evictCold() {
+	type candidate struct {
+		page     *PageHit
+		size     int64
+		lastUsed int64
+		uses     uint64
+	}
+	var pages []candidate
+	var used int64
+	hcs.pages.each(func(page *PageHit) bool {
+		c := candidate{page: page, size: page.size(), lastUsed: page.lastUsed.Load(), uses: page.uses.Load()}
+		used += c.size
+		pages = append(pages, c)
+		return true
+	})
+	if used <= hcs.cfg.MemoryBudget {
+		return
+	}
+
+	lfu := hcs.cfg.EvictPolicy == "lfu"
+	sort.Slice(pages, func(i, j int) bool {
+		if lfu && pages[i].uses != pages[j].uses {
+			return pages[i].uses < pages[j].uses
+		}
+		return pages[i].lastUsed < pages[j].lastUsed
+	})
+	target := hcs.cfg.MemoryBudget / 10 * 9
+	for _, c := range pages {
+		if used <= target {
+			break
+		}
+		if hcs.pages.evict(c.page) {
+			used -= c.size
+		}
+	}
+
+	if lfu {
+		// halve the use counts after every round so pages that were popular long ago cool down.
+		// a hit landing between the load and the store is lost, it's only a ranking
+		hcs.pages.each(func(page *PageHit) bool {
+			page.uses.Store(page.uses.Load() / 2)
+			return true
+		})
+	}
+}
+
+// memory of the pages for the stats output
+type memoryStats struct {
+	Used      int64  `json:"used"`   // estimated bytes of the pages in memory
+	Budget    int64  `json:"budget"` // 0 when there is no budget
+	Pages     int    `json:"pages"`  // pages in memory
+	Spilled   int64  `json:"spilled"`
+	Evictions uint64 `json:"evictions"`
+	Reloads   uint64 `json:"reloads"`
+}
+
+func (hcs *HitCounterServer) memoryStats() memoryStats {
+	m := memoryStats{Budget: hcs.cfg.MemoryBudget, Evictions: hcs.pages.evictions.Load(), Reloads: hcs.pages.reloads.Load()}
+	hcs.pages.each(func(page *PageHit) bool {
+		m.Used += page.size()
+		m.Pages++
+		return true
+	})
+	if hcs.pages.spill != nil {
+		m.Spilled = hcs.pages.spill.pages.Load()
+	}
+	return m
+}
+
+// sizes like 512K, 64M or 2G, plain numbers are bytes
+func parseSize(value string) (int64, error) {
+	shifts := map[string]uint{"K": 10, "M": 20, "G": 30}
+	number, shift := value, uint(0)
+	if n := len(value); n > 0 {
+		if sh, ok := shifts[strings.ToUpper(value[n-1:])]; ok {
+			number, shift = value[:n-1], sh
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", value)
+	}
+	return n << shift, nil
+}
+
+// steps of the canonicalization pipeline, always applied in this order
+var canonicalSteps = []string{"fragment", "decode", "lowercase", "trailing-slash", "tracking-params"}
+
+// canonicalization of page names so /Home, /home/ and /home?utm_source=x
+// are all counted as /home. aliases are applied last on the canonical name
+type canonicalizer struct {
+	steps    map[string]bool
+	tracking []string
+	aliases  map[string]string
+}
+
+func newCanonicalizer(cfg Config) *canonicalizer {
+	c := &canonicalizer{steps: make(map[string]bool), aliases: cfg.Aliases}
+	for _, step := range cfg.Normalize {
+		c.steps[strings.TrimSpace(step)] = true
+	}
+	for _, param := range cfg.TrackingParams {
+		if param = strings.TrimSpace(param); param != "" {
+			c.tracking = append(c.tracking, strings.ToLower(param))
+		}
+	}
+	return c
+}
+
+// unknown steps in the configuration, reported by main
+func unknownSteps(steps []string) []string {
+	var unknown []string
+	for _, step := range steps {
+		step = strings.TrimSpace(step)
+		known := step == ""
+		for _, s := range canonicalSteps {
+			known = known || s == step
+		}
+		if !known {
+			unknown = append(unknown, step)
+		}
+	}
+	return unknown
+}
+
+func (c *canonicalizer) isTracking(param string) bool {
+	param = strings.ToLower(param)
+	for _, t := range c.tracking {
+		if strings.HasSuffix(t, "*") && strings.HasPrefix(param, strings.TrimSuffix(t, "*")) || t == param {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical key of a page name. steps that can't parse the name leave it as it is
+func (c *canonicalizer) apply(name string) string {
+	if len(c.steps) == 0 && len(c.aliases) == 0 {
+		return name
+	}
+
+	if c.steps["fragment"] {
+		name, _, _ = strings.Cut(name, "#")
+	}
+	p, query, hasQuery := strings.Cut(name, "?")
+	if c.steps["decode"] {
+		if decoded, err := url.PathUnescape(p); err == nil {
+			p = decoded
+		}
+	}
+	if c.steps["lowercase"] {
+		p = strings.ToLower(p)
+	}
+	if c.steps["trailing-slash"] {
+		for len(p) > 1 && strings.HasSuffix(p, "/") {
+			p = p[:len(p)-1]
+		}
+	}
+	if hasQuery && c.steps["tracking-params"] {
+		if values, err := url.ParseQuery(query); err == nil {
+			for key := range values {
+				if c.isTracking(key) {
+					values.Del(key)
+				}
+			}
+			query = values.Encode() // also sorts the parameters so their order doesn't matter
+		}
+	}
+
+	name = p
+	if hasQuery && query != "" {
+		name += "?" + query
+	}
+	if alias, ok := c.aliases[name]; ok {
+		name = alias
+	}
+	return name
+}
+
+// canonical form of a prefix like the one of WATCH /Blog/*. only the steps that
+// keep a prefix a prefix apply: a trailing slash or a query are part of it.
+// like apply they only change the path, the query keeps its case
+func (c *canonicalizer) applyPrefix(prefix string) string {
+	p, query, hasQuery := strings.Cut(prefix, "?")
+	if c.steps["decode"] {
+		if decoded, err := url.PathUnescape(p); err == nil {
+			p = decoded
+		}
+	}
+	if c.steps["lowercase"] {
+		p = strings.ToLower(p)
+	}
+	if hasQuery {
+		p += "?" + query
+	}
+	return p
+}
+
+// why a hit was not counted
+var (
+	errBotHit     = errors.New("bot user agent")
+	errRateLimit  = errors.New("rate limited")
+	errDuplicate  = errors.New("duplicate hit")
+	errInvalidHit = errors.New("invalid page")
+)
+
+// one hit as it arrives from any of the protocols
+type hitRequest struct {
+	Page    string
+	Visitor string
+	Remote  string // ip of the sender, for the per address limit
+	UA      string // user agent, for the bot deny list
+	Tags    map[string]string
+	Count   uint64 // hits carried by the request, 0 means 1
+
+	// the hits were already summed by the sender (statsd, HITS, INCRBY, redis INCR), so the
+	// visitor is the sending host and not a person: the per visitor limit and the duplicate
+	// suppression don't apply, the per address limit and the bot deny list still do
+	Aggregate bool
+}
+
+// token bucket of one sender
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// per key token buckets, rate tokens per second up to burst
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// forget the senders whose bucket is full again, they look like new senders anyway
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// most visitor/page pairs the duplicate filter remembers, past it hits are counted
+// rather than letting a flood of new visitors grow the map without limit
+const maxDedupEntries = 1 << 20
+
+// remembers when each visitor last got a hit counted on each page
+type dedupCache struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{window: window, seen: make(map[string]time.Time)}
+}
+
+// false when the visitor already got a hit counted on the page within the window
+func (d *dedupCache) allow(visitor, page string, now time.Time) bool {
+	key := visitor + "\x00" + page
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if last, ok := d.seen[key]; ok && now.Sub(last) < d.window {
+		return false
+	}
+	if len(d.seen) >= maxDedupEntries {
+		d.sweepLocked(now)
+		if len(d.seen) >= maxDedupEntries {
+			return true
+		}
+	}
+	d.seen[key] = now
+	return true
+}
+
+func (d *dedupCache) sweep(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweepLocked(now)
+}
+
+func (d *dedupCache) sweepLocked(now time.Time) {
+	for key, last := range d.seen {
+		if now.Sub(last) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// counts of the hits dropped by the abuse protection, per reason
+type filterStats struct {
+	bots       atomic.Uint64
+	rateLimits atomic.Uint64
+	duplicates atomic.Uint64
+}
+
+// abuse protection in front of the counters: a bot deny list, per address and
+// per visitor rate limits and duplicate suppression, checked in that order
+type hitFilter struct {
+	denyUA       []string // lower cased user agent fragments
+	ipLimit      *rateLimiter
+	visitorLimit *rateLimiter
+	dedup        *dedupCache
+	stats        filterStats
+}
+
+func newHitFilter(cfg Config) *hitFilter {
+	f := &hitFilter{}
+	for _, sig := range cfg.DenyUA {
+		if sig = strings.ToLower(strings.TrimSpace(sig)); sig != "" {
+			f.denyUA = append(f.denyUA, sig)
+		}
+	}
+	if cfg.IPRate > 0 {
+		f.ipLimit = newRateLimiter(cfg.IPRate, cfg.RateBurst)
+	}
+	if cfg.VisitorRate > 0 {
+		f.visitorLimit = newRateLimiter(cfg.VisitorRate, cfg.RateBurst)
+	}
+	if cfg.DedupWindow > 0 {
+		f.dedup = newDedupCache(cfg.DedupWindow)
+	}
+	return f
+}
+
+// nil when the hit should be counted, else the reason it is dropped
+func (f *hitFilter) check(req hitRequest, now time.Time) error {
+	if req.UA != "" && len(f.denyUA) > 0 {
+		ua := strings.ToLower(req.UA)
+		for _, sig := range f.denyUA {
+			if strings.Contains(ua, sig) {
+				f.stats.bots.Add(1)
+				return errBotHit
+			}
+		}
+	}
+	if (f.ipLimit != nil && req.Remote != "" && !f.ipLimit.allow(req.Remote, now)) ||
+		(f.visitorLimit != nil && !req.Aggregate && !f.visitorLimit.allow(req.Visitor, now)) {
+		f.stats.rateLimits.Add(1)
+		return errRateLimit
+	}
+	if f.dedup != nil && !req.Aggregate && !f.dedup.allow(req.Visitor, req.Page, now) {
+		f.stats.duplicates.Add(1)
+		return errDuplicate
+	}
+	return nil
+}
+
+// drop the limiter and dedup entries that don't matter anymore
+func (f *hitFilter) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		if f.ipLimit != nil {
+			f.ipLimit.sweep(now)
+		}
+		if f.visitorLimit != nil {
+			f.visitorLimit.sweep(now)
+		}
+		if f.dedup != nil {
+			f.dedup.sweep(now)
+		}
+	}
+}
+
+// settings of the server, filled from the command line flags in main
+type Config struct {
+	Addr        string // address of the tcp protocol
+	HTTPAddr    string // address of the http listener, empty disables it
+	AllowOrigin string // value of Access-Control-Allow-Origin sent by the http endpoints
+
+	NodeID         string        // name of this node in the G-counters, unique in the cluster
+	GossipAddr     string        // address where peers sync with us, empty disables replication
+	Peers          []string      // gossip addresses of the other nodes
+	GossipInterval time.Duration // how often we sync with a random peer
+
+	DenyUA      []string      // user agent fragments of bots whose hits are dropped
+	IPRate      float64       // hits per second allowed per sender address, 0 disables the limit
+	VisitorRate float64       // hits per second allowed per visitor, 0 disables the limit
+	RateBurst   int           // hits a sender or visitor can send at once before the rate applies
+	DedupWindow time.Duration // a visitor hitting the same page within it counts once, 0 disables it
+
+	RESPAddr   string // address of the redis protocol, empty disables it
+	StatsDAddr string // udp address of the statsd listener, empty disables it
+
+	Normalize      []string          // canonicalization steps applied to page names, see canonicalSteps
+	TrackingParams []string          // query parameters dropped by the tracking-params step, name or prefix*
+	Aliases        map[string]string // canonical page -> page it is counted as
+
+	AdminToken string // secret of AUTH, empty disables the admin commands
+	AuditLog   string // file where every admin action is appended
+
+	AlertInterval time.Duration // how often the alert rules are evaluated
+	AlertWebhook  string        // url the alert events are posted to, empty disables it
+
+	MemoryBudget int64  // estimated bytes the pages may take before cold ones are evicted, 0 disables eviction
+	EvictPolicy  string // "lru" or "lfu"
+	SpillDir     string // directory where evicted pages are written
+
+	StateFile       string        // every page is saved there on shutdown and loaded at startup, empty disables it
+	ShutdownTimeout time.Duration // how long the shutdown waits for the connections to finish
+	IdleTimeout     time.Duration // how long a connection may wait between commands, 0 disables it
+	ReadTimeout     time.Duration // how long a client may take to send a command once it started, 0 disables it
+
+	ImportFile string // rows of EXPORT loaded at startup, empty disables it
+	ImportMode string // "merge" or "replace"
+
+	HistoryDir      string        // directory of the hit history, empty disables it
+	MinuteRetention time.Duration // how long each resolution of the history is kept
+	HourRetention   time.Duration
+	DayRetention    time.Duration
+}
+
+// what we know about a peer for the PEERS command
+type peerState struct {
+	Addr     string
+	LastSync time.Time
+	LastErr  error
+}
+
+// struct that keeps the data of pages and their hit
+type HitCounterServer struct {
+	cfg   Config
+	pages *pageStore     // sharded map of the pages, the PageHit counters themselves are atomic
+	wg    sync.WaitGroup // to keep track of goroutines
+	top   *topStripes    // heavy hitters of the recent windows for TOP
+
+	peersMu sync.Mutex
+	peers   []*peerState
+
+	watchMu      sync.RWMutex
+	watchers     map[*watcher]struct{} // every WATCH of every client
+	pushWatchers atomic.Int32          // watchers that want every hit, lets recordHit skip the lock when there are none
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]*clientConn // open connections, nil values are redis ones
+
+	canon   *canonicalizer // turns the page names of the hits into the keys of pages
+	filter  *hitFilter     // abuse protection in front of recordHit
+	alerts  *alertManager  // traffic alerts and their subscribers
+	audit   *auditLog      // record of the admin actions, opened by Run
+	history *historyStore  // on disk time series of the hits, nil when disabled
+}
+
+func NewHitCounterServer(cfg Config) *HitCounterServer {
+	hcs := &HitCounterServer{
+		cfg:      cfg,
+		pages:    newPageStore(),
+		top:      newTopStripes(),
+		watchers: make(map[*watcher]struct{}),
+		filter:   newHitFilter(cfg),
+		canon:    newCanonicalizer(cfg),
+		alerts:   newAlertManager(cfg),
+		conns:    make(map[net.Conn]*clientConn),
+	}
+	if cfg.HistoryDir != "" {
+		hcs.history = newHistoryStore(cfg)
+	}
+	for _, addr := range cfg.Peers {
+		hcs.peers = append(hcs.peers, &peerState{Addr: addr})
+	}
+	return hcs
+}
+
+// run the server until ctx is done, then shut it down gracefully
+func (hcs *HitCounterServer) Run(ctx context.Context) {
+	if hcs.cfg.AdminToken != "" {
+		audit, err := openAuditLog(hcs.cfg.AuditLog)
+		if err != nil {
+			fmt.Println("Server Error:", err)
+			return
+		}
+		defer audit.Close()
+		hcs.audit = audit
+	}
+
+	// the pages saved by the last shutdown
+	if hcs.cfg.StateFile != "" {
+		if _, err := os.Stat(hcs.cfg.StateFile); err == nil {
+			n, err := hcs.loadState(hcs.cfg.StateFile)
+			if err != nil {
+				fmt.Println("State Error:", err)
+				return
+			}
+			fmt.Printf("Loaded %d pages from %s\n", n, hcs.cfg.StateFile)
+		}
+	}
+
+	// counts moved from another environment are in place before the first hit
+	if hcs.cfg.ImportFile != "" {
+		n, err := hcs.importFile(hcs.cfg.ImportFile, hcs.cfg.ImportMode)
+		if err != nil {
+			fmt.Println("Import Error:", err)
+			return
+		}
+		fmt.Printf("Imported %d pages from %s (%s)\n", n, hcs.cfg.ImportFile, hcs.cfg.ImportMode)
+	}
+
+	// set before the listeners start, every hit may reload a page from it
+	if hcs.cfg.MemoryBudget > 0 {
+		spill, err := openSpillStore(hcs.cfg.SpillDir)
+		if err != nil {
+			fmt.Println("Server Error:", err)
+			return
+		}
+		hcs.pages.spill = spill
+	}
+
+	ln, err := net.Listen("tcp", hcs.cfg.Addr)
+	if err != nil {
+		fmt.Println("Server Error:", err)
+		return
+	}
+
+	defer ln.Close()
+	fmt.Printf("Hit Counter Server started on %s\n", hcs.cfg.Addr)
+	// closing the listener is what stops the accept loop
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	// websites can't talk raw tcp so they send their hits over http to the same pages
+	if hcs.cfg.HTTPAddr != "" {
+		hcs.wg.Add(1)
+		go hcs.runHTTP(ctx)
+	}
+
+	// redis clients and redis-cli talk to the same pages through RESP
+	if hcs.cfg.RESPAddr != "" {
+		hcs.wg.Add(1)
+		go hcs.runRESP(ctx)
+	}
+
+	// high volume apps fire and forget their hits as statsd counters.
+	// part of wg like every listener so the state is saved after their last hit
+	if hcs.cfg.StatsDAddr != "" {
+		hcs.wg.Add(1)
+		go hcs.runStatsD(ctx)
+	}
+
+	// several instances behind a load balancer sync their counters with each other
+	if hcs.cfg.GossipAddr != "" {
+		hcs.wg.Add(1)
+		go hcs.runGossip(ctx)
+	}
+
+	go hcs.filter.runSweeper(ctx)
+
+	go hcs.runAlerts(ctx)
+	// part of wg so a post in progress is cancelled and waited for by the shutdown
+	if hcs.alerts.webhook != nil {
+		hcs.wg.Add(1)
+		go hcs.runWebhook(ctx)
+	}
+
+	// crawlers hitting random urls would grow the pages forever, cold ones go to disk
+	if hcs.pages.spill != nil {
+		// part of wg so no page moves to disk while the state is saved
+		hcs.wg.Add(1)
+		go hcs.runEvictor(ctx)
+	}
+
+	// part of wg so the last rollup of the shutdown doesn't run next to it
+	if hcs.history != nil {
+		hcs.wg.Add(1)
+		go hcs.runHistory(ctx)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Println("Server Disconnected: ", err)
+			return
+		}
+		hcs.wg.Add(1)
+		go hcs.handleClient(conn)
+	}
+	hcs.shutdown()
+}
+
+// after the listeners are closed: tell the clients, stop reading from them so
+// their handlers return once the command in progress is answered, wait for
+// them up to ShutdownTimeout and write what has to survive the restart
+func (hcs *HitCounterServer) shutdown() {
+	fmt.Println("Shutting down")
+	hcs.connsMu.Lock()
+	for raw, conn := range hcs.conns {
+		if conn != nil {
+			// a client that doesn't read doesn't hold up the shutdown
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			fmt.Fprintf(conn, "Server shutting down\n")
+			conn.SetWriteDeadline(time.Time{})
+		}
+		if tcp, ok := raw.(*net.TCPConn); ok {
+			tcp.CloseRead()
+		} else {
+			raw.SetReadDeadline(time.Now())
+		}
+	}
+	hcs.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		hcs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(hcs.cfg.ShutdownTimeout):
+		fmt.Println("Shutdown timed out, closing the remaining connections")
+		hcs.connsMu.Lock()
+		for raw := range hcs.conns {
+			raw.Close()
+		}
+		hcs.connsMu.Unlock()
+		// the handlers notice the closed connections right away, but one may
+		// still be writing a page, which has to land before the pages are saved
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			fmt.Println("Some handlers are still running, saving the pages anyway")
+		}
+	}
+	hcs.flush()
+	fmt.Println("Server stopped")
+}
+
+// write the state that has to survive a restart, when it is configured
+func (hcs *HitCounterServer) flush() {
+	if hcs.history != nil {
+		hcs.rollup(time.Now().UTC()) // the hits since the last minute
+	}
+	if hcs.cfg.StateFile != "" {
+		n, err := hcs.saveState(hcs.cfg.StateFile)
+		if err != nil {
+			fmt.Println("State Error:", err)
+			return
+		}
+		fmt.Printf("Saved %d pages to %s\n", n, hcs.cfg.StateFile)
+	}
+}
+
+// one json line of the state file: the header with the node that wrote it,
+// then a page or a tombstone per line
+type stateRecord struct {
+	Node    string        `json:"node,omitempty"`
+	Page    *pageSnapshot `json:"page,omitempty"`
+	Deleted string        `json:"deleted,omitempty"`
+	Epoch   uint64        `json:"epoch,omitempty"`
+}
+
+// write every page, evicted ones included, as the snapshots of the spill store so the
+// whole G-counter (epoch, our entry and the replicas) survives, not just the total.
+// it goes into a temporary file renamed over path so a crash while saving leaves
+// the previous state
+func (hcs *HitCounterServer) saveState(path string) (int, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // fails once renamed
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	n := 0
+	err = enc.Encode(stateRecord{Node: hcs.cfg.NodeID})
+	if err == nil {
+		hcs.pages.each(func(page *PageHit) bool {
+			snap := page.snapshot()
+			if err = enc.Encode(stateRecord{Page: &snap}); err != nil {
+				return false
+			}
+			n++
+			return true
+		})
+	}
+	if err == nil {
+		// the files of the evicted pages already hold their snapshot, copied as they are
+		hcs.pages.eachEvicted(func(name string, _ *evictedPage) bool {
+			var data []byte
+			if data, err = os.ReadFile(hcs.pages.spill.path(name)); err != nil {
+				return false
+			}
+			if err = enc.Encode(map[string]json.RawMessage{"page": data}); err != nil {
+				return false
+			}
+			n++
+			return true
+		})
+	}
+	if err == nil {
+		for name, epoch := range hcs.pages.tombstones() {
+			if err = enc.Encode(stateRecord{Deleted: name, Epoch: epoch}); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+// put back the pages and tombstones of saveState as they were. the counts of a
+// node that ran under another name are kept as that node's replica entry
+func (hcs *HitCounterServer) loadState(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+
+	var header stateRecord
+	if err := dec.Decode(&header); err != nil || header.Node == "" {
+		return 0, fmt.Errorf("%s is not a state file", path)
+	}
+	n := 0
+	for {
+		var rec stateRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("%s: %v", path, err)
+		}
+		if rec.Deleted != "" {
+			hcs.pages.restoreTomb(rec.Deleted, rec.Epoch)
+			continue
+		}
+		if rec.Page == nil {
+			continue
+		}
+		if header.Node != hcs.cfg.NodeID && rec.Page.Hit > 0 {
+			if rec.Page.Replicas == nil {
+				rec.Page.Replicas = make(map[string]uint64)
+			}
+			if rec.Page.Hit > rec.Page.Replicas[header.Node] {
+				rec.Page.Replicas[header.Node] = rec.Page.Hit
+			}
+			rec.Page.Hit = 0
+		}
+		page, err := pageFromSnapshot(*rec.Page)
+		if err != nil {
+			return n, fmt.Errorf("%s: page %s: %v", path, rec.Page.Name, err)
+		}
+		hcs.pages.restore(page)
+		n++
+	}
+}
+
+// open connections of the tcp and redis protocols, so the shutdown can reach them
+func (hcs *HitCounterServer) trackConn(raw net.Conn, conn *clientConn) {
+	hcs.connsMu.Lock()
+	defer hcs.connsMu.Unlock()
+	hcs.conns[raw] = conn
+}
+
+func (hcs *HitCounterServer) untrackConn(raw net.Conn) {
+	hcs.connsMu.Lock()
+	defer hcs.connsMu.Unlock()
+	delete(hcs.conns, raw)
+}
+
+// wait for the next command of a connection. it may stay idle up to IdleTimeout
+// when idle is true, then it has ReadTimeout to send the whole command
+func (hcs *HitCounterServer) awaitCommand(conn net.Conn, reader *bufio.Reader, idle bool) error {
+	if reader.Buffered() == 0 {
+		deadline := time.Time{}
+		if idle && hcs.cfg.IdleTimeout > 0 {
+			deadline = time.Now().Add(hcs.cfg.IdleTimeout)
+		}
+		conn.SetReadDeadline(deadline)
+		if _, err := reader.Peek(1); err != nil {
+			return err
+		}
+	}
+	deadline := time.Time{}
+	if hcs.cfg.ReadTimeout > 0 {
+		deadline = time.Now().Add(hcs.cfg.ReadTimeout)
+	}
+	return conn.SetReadDeadline(deadline)
+}
+
+// connection of a client. watchers write to it from their own goroutines
+// so every write takes the lock to keep lines from interleaving
+type clientConn struct {
+	net.Conn
+	mu       sync.Mutex
+	watchers map[string]*watcher // WATCH target -> watcher, only used by the client goroutine
+	admin    bool                // the client sent the right AUTH token
+	quiet    bool                // QUIET ON, hits are not acknowledged so clients can pipeline them
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (hcs *HitCounterServer) handleClient(netConn net.Conn) {
+	defer hcs.wg.Done()
+	defer netConn.Close()
+
+	conn := &clientConn{Conn: netConn, watchers: make(map[string]*watcher)}
+	defer hcs.unwatchAll(conn) // a disconnect removes the watchers of the client
+	defer hcs.alerts.unsubscribe(conn)
+	hcs.trackConn(netConn, conn)
+	defer hcs.untrackConn(netConn)
+
+	reader := bufio.NewReader(conn) // connect to the client to read their message
+	fmt.Fprintf(conn, "Send 'GET <page> [visitor-id] [key=value]...' to record a hit, 'HITS <page>...', 'INCRBY <page> <n>', 'QUIET ON|OFF', 'STATS [PREFIX|SORT|LIMIT|OFFSET|CURSOR|FORMAT <v>]...' for totals, 'STATS <page> [WINDOW <d> | BY <dimension>]', 'RATE <page>', 'UNIQUES <page> [WINDOW <d>]', 'TOP <k> [WINDOW <d>]', 'WATCH <page|prefix*> [interval]', 'UNWATCH [target]', 'HISTORY <page> FROM <t1> TO <t2> STEP <d>', 'ALERT ADD|DEL|LIST|SUBSCRIBE', 'EXPORT json|csv', 'FILTERED', 'PEERS', 'AUTH <token>' for admin commands or 'exit' to quit:\n")
+
+	for {
+		// clients that watch pages or alerts only listen, they are never idle
+		idle := len(conn.watchers) == 0 && !hcs.alerts.subscribed(conn)
+		err := hcs.awaitCommand(conn, reader, idle)
+		input := ""
+		if err == nil {
+			input, err = reader.ReadString('\n') // read client message
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				fmt.Fprintf(conn, "Timed out, closing the connection\n")
+			}
+			fmt.Printf("Client %s Disconnected", conn.RemoteAddr().String())
+			return
+		}
+
+		cmd := strings.TrimSpace(input)
+		if cmd == "exit" {
+			fmt.Printf("Client %s exited\n", conn.RemoteAddr().String())
+			return
+		}
+
+		// listing of the pages: STATS [PREFIX <p>] [SORT hits|name] [LIMIT <n>] [OFFSET <n>|CURSOR <c>] [FORMAT json|csv|text]
+		if cmd == "STATS" || (strings.HasPrefix(cmd, "STATS ") && isListOption(strings.Fields(cmd)[1])) {
+			hcs.listStats(conn, strings.Fields(cmd)[1:])
+			continue
+		}
+
+		// windowed stats for a single page: STATS <page> [WINDOW <duration>]
+		if strings.HasPrefix(cmd, "STATS ") {
+			hcs.pageStats(conn, strings.Fields(strings.TrimPrefix(cmd, "STATS ")))
+			continue
+		}
+
+		if strings.HasPrefix(cmd, "RATE ") {
+			ph := strings.TrimSpace(strings.TrimPrefix(cmd, "RATE "))
+			page, ok := hcs.lookupPage(ph)
+			if !ok {
+				fmt.Fprintf(conn, "Unknown page %s\n", ph)
+				continue
+			}
+			fmt.Fprintf(conn, "Site %s Rate %.2f hits/s\n", page.Name, page.rate())
+			continue
+		}
+
+		if strings.HasPrefix(cmd, "UNIQUES ") {
+			hcs.pageUniques(conn, strings.Fields(strings.TrimPrefix(cmd, "UNIQUES ")))
+			continue
+		}
+
+		if strings.HasPrefix(cmd, "WATCH ") {
+			hcs.watch(conn, strings.Fields(strings.TrimPrefix(cmd, "WATCH ")))
+			continue
+		}
+
+		if cmd == "UNWATCH" || strings.HasPrefix(cmd, "UNWATCH ") {
+			target := strings.TrimSpace(strings.TrimPrefix(cmd, "UNWATCH"))
+			if target == "" {
+				hcs.unwatchAll(conn)
+				fmt.Fprintf(conn, "Stopped watching everything\n")
+				continue
+			}
+			if !hcs.unwatch(conn, target) {
+				fmt.Fprintf(conn, "Not watching %s\n", target)
+				continue
+			}
+			fmt.Fprintf(conn, "Stopped watching %s\n", target)
+			continue
+		}
+
+		if cmd == "ALERT" || strings.HasPrefix(cmd, "ALERT ") {
+			hcs.alertCommand(conn, strings.Fields(cmd)[1:])
+			continue
+		}
+
+		if strings.HasPrefix(cmd, "EXPORT ") {
+			hcs.exportPages(conn, strings.Fields(strings.TrimPrefix(cmd, "EXPORT ")))
+			continue
+		}
+
+		if args := strings.Fields(cmd); len(args) > 0 && args[0] == "IMPORT" {
+			hcs.importCommand(conn, reader, args)
+			continue
+		}
+
+		if strings.HasPrefix(cmd, "AUTH ") {
+			hcs.authenticate(conn, strings.TrimSpace(strings.TrimPrefix(cmd, "AUTH ")))
+			continue
+		}
+
+		if args := strings.Fields(cmd); len(args) > 0 && adminCommands[args[0]] {
+			hcs.adminCommand(conn, args)
+			continue
+		}
+
+		if strings.HasPrefix(cmd, "HISTORY ") {
+			hcs.pageHistory(conn, strings.Fields(strings.TrimPrefix(cmd, "HISTORY ")))
+			continue
+		}
+
+		if cmd == "FILTERED" {
+			stats := &hcs.filter.stats
+			fmt.Fprintf(conn, "Filtered bots %d rate-limited %d duplicates %d\n",
+				stats.bots.Load(), stats.rateLimits.Load(), stats.duplicates.Load())
+			continue
+		}
+
+		if cmd == "PEERS" {
+			hcs.listPeers(conn)
+			continue
+		}
+
+		if strings.HasPrefix(cmd, "TOP ") {
+			hcs.topPages(conn, strings.Fields(strings.TrimPrefix(cmd, "TOP ")))
+			continue
+		}
+
+		if cmd == "HITS" || strings.HasPrefix(cmd, "HITS ") {
+			hcs.batchHits(conn, strings.Fields(strings.TrimPrefix(cmd, "HITS")))
+			continue
+		}
+
+		if strings.HasPrefix(cmd, "INCRBY ") {
+			hcs.incrBy(conn, strings.Fields(strings.TrimPrefix(cmd, "INCRBY ")))
+			continue
+		}
+
+		if cmd == "QUIET ON" || cmd == "QUIET OFF" {
+			conn.quiet = cmd == "QUIET ON"
+			fmt.Fprintf(conn, "Quiet mode %s\n", strings.ToLower(strings.TrimPrefix(cmd, "QUIET ")))
+			continue
+		}
+
+		// check if client wants to visite website
+		if strings.HasPrefix(cmd, "GET ") {
+			// parse the website name, the optional visitor and the key=value tags.
+			// a page may carry a query string, anything else with a = is a tag
+			args := strings.Fields(strings.TrimPrefix(cmd, "GET "))
+			if len(args) == 0 || strings.Contains(args[0], "=") && !strings.Contains(args[0], "?") {
+				fmt.Fprintf(conn, "Invalid Page\n")
+				continue
+			}
+			name, args := args[0], args[1:]
+
+			// visitors without an id are told apart by their ip
+			visitor := hostOf(conn.RemoteAddr().String())
+			if len(args) > 0 && !strings.Contains(args[0], "=") {
+				visitor, args = args[0], args[1:]
+			}
+			tags, err := parseTags(args)
+			if err != nil {
+				fmt.Fprintf(conn, "Invalid Page: %v\n", err)
+				continue
+			}
+
+			page, total, err := hcs.recordHit(hitRequest{
+				Page:    name,
+				Visitor: visitor,
+				Remote:  hostOf(conn.RemoteAddr().String()),
+				UA:      tags["ua"],
+				Tags:    tags,
+			})
+			if conn.quiet {
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(conn, "Hit filtered for %s: %v\n", name, err)
+				continue
+			}
+			fmt.Printf("Recorded hit for %s from %s (total: %d)\n", page.Name, conn.RemoteAddr().String(), total)
+			fmt.Fprintf(conn, "Hit recorded for %s\n", page.Name)
+			continue
+		}
+		fmt.Fprintf(conn, "Unknown command: %s\n", cmd)
+	}
+}
+
+// HITS <page1> <page2> ... records one hit per page with a single answer.
+// the same page can be listed several times
+func (hcs *HitCounterServer) batchHits(conn *clientConn, pages []string) {
+	if len(pages) == 0 {
+		fmt.Fprintf(conn, "Usage: HITS <page1> <page2> ...\n")
+		return
+	}
+	remote := hostOf(conn.RemoteAddr().String())
+	var recorded, filtered, invalid int
+	for _, name := range pages {
+		_, _, err := hcs.recordHit(hitRequest{Page: name, Visitor: remote, Remote: remote, Aggregate: true})
+		switch {
+		case err == errInvalidHit:
+			invalid++
+		case err != nil:
+			filtered++
+		default:
+			recorded++
+		}
+	}
+	if invalid > 0 {
+		fmt.Fprintf(conn, "Invalid Page: %d of the %d pages\n", invalid, len(pages))
+		return
+	}
+	if !conn.quiet {
+		fmt.Fprintf(conn, "Hits recorded %d filtered %d\n", recorded, filtered)
+	}
+}
+
+// INCRBY <page> <n> records n hits of a page at once
+func (hcs *HitCounterServer) incrBy(conn *clientConn, args []string) {
+	if len(args) != 2 {
+		fmt.Fprintf(conn, "Usage: INCRBY <page> <n>\n")
+		return
+	}
+	n, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil || n == 0 {
+		fmt.Fprintf(conn, "Invalid count %s\n", args[1])
+		return
+	}
+	remote := hostOf(conn.RemoteAddr().String())
+	page, total, err := hcs.recordHit(hitRequest{Page: args[0], Visitor: remote, Remote: remote, Count: n, Aggregate: true})
+	switch {
+	case err == errInvalidHit:
+		fmt.Fprintf(conn, "Invalid Page\n")
+	case conn.quiet:
+	case err != nil:
+		fmt.Fprintf(conn, "Hit filtered for %s: %v\n", args[0], err)
+	default:
+		fmt.Fprintf(conn, "Hits recorded for %s (total: %d)\n", page.Name, total)
+	}
+}
+
+// every way of sending a hit (tcp or http) ends up here. hits dropped by the
+// abuse protection are only counted in the filtered counters and return why,
+// the page is nil for them when it doesn't exist
+func (hcs *HitCounterServer) recordHit(req hitRequest) (*PageHit, uint64, error) {
+	req.Page = hcs.canon.apply(req.Page)
+	if req.Page == "" {
+		return nil, 0, errInvalidHit
+	}
+	now := time.Now()
+	hash := hcs.pages.hash(req.Page)
+
+	n := req.Count
+	if n == 0 {
+		n = 1
+	}
+
+	// a filtered hit only shows up on a page that already exists, else a denied
+	// crawler hitting random urls would still grow the pages without bound
+	if err := hcs.filter.check(req, now); err != nil {
+		var total uint64
+		page := hcs.pages.updateExisting(hash, req.Page, func(page *PageHit) {
+			page.filtered.Add(n)
+			total = page.total()
+		})
+		return page, total, err
+	}
+	var total uint64
+	page := hcs.pages.update(hash, req.Page, func(page *PageHit) {
+		page.touch()
+		total = page.record(n, req.Visitor, req.Tags)
+	})
+
+	hcs.top.add(now, hash, page.Name, n)
+	if hcs.pushWatchers.Load() > 0 {
+		hcs.notifyWatchers(page.Name)
+	}
+	return page, total, nil
+}
+
+// change a page, creating it if needed, without racing with its eviction
+func (hcs *HitCounterServer) updatePage(page string, fn func(*PageHit)) *PageHit {
+	return hcs.pages.update(hcs.pages.hash(page), page, fn)
+}
+
+// find a page without creating it, used by the read only commands.
+// the name is canonicalized like the hits so STATS /Home finds /home
+func (hcs *HitCounterServer) lookupPage(page string) (*PageHit, bool) {
+	return hcs.pages.get(hcs.canon.apply(page))
+}
+
+// STATS <page> shows the lifetime total with the last minute, hour and day,
+// STATS <page> WINDOW <duration> shows only the hits of that window and
+// STATS <page> BY <dimension> breaks the lifetime hits down by a tag
+func (hcs *HitCounterServer) pageStats(conn net.Conn, args []string) {
+	if len(args) != 1 && !(len(args) == 3 && (strings.ToUpper(args[1]) == "WINDOW" || strings.ToUpper(args[1]) == "BY")) {
+		fmt.Fprintf(conn, "Usage: STATS <page> [WINDOW <duration> | BY <dimension>]\n")
+		return
+	}
+
+	page, ok := hcs.lookupPage(args[0])
+	if !ok {
+		fmt.Fprintf(conn, "Unknown page %s\n", args[0])
+		return
+	}
+
+	if len(args) == 3 && strings.ToUpper(args[1]) == "BY" {
+		dim := strings.ToLower(args[2])
+		values, ok := page.tags.breakdown(dim)
+		if !ok {
+			fmt.Fprintf(conn, "Site %s has no hits tagged with %s\n", page.Name, dim)
+			return
+		}
+		for _, v := range values {
+			fmt.Fprintf(conn, "Site %s %s=%s Hit %d\n", page.Name, dim, v.Name, v.Hits)
+		}
+		return
+	}
+
+	if len(args) == 3 {
+		d, err := time.ParseDuration(args[2])
+		if err != nil || d <= 0 {
+			fmt.Fprintf(conn, "Invalid window %s\n", args[2])
+			return
+		}
+		n, err := page.windowHits(d)
+		if err != nil {
+			fmt.Fprintf(conn, "Invalid window: %v\n", err)
+			return
+		}
+		fmt.Fprintf(conn, "Site %s Hit %d in last %s\n", page.Name, n, d)
+		return
+	}
+
+	minute, _ := page.windowHits(time.Minute)
+	hour, _ := page.windowHits(time.Hour)
+	day, _ := page.windowHits(24 * time.Hour)
+	fmt.Fprintf(conn, "Site %s Hit %d (1m: %d, 1h: %d, 24h: %d) Uniques %d Filtered %d\n",
+		page.Name, page.total(), minute, hour, day, page.uniques.total(), page.filtered.Load())
+}
+
+// options of the STATS listing
+type listQuery struct {
+	Prefix string
+	Sort   string // "name" or "hits"
+	Limit  int    // 0 means no limit
+	Offset int
+	Cursor string
+	Format string // "text", "json" or "csv"
+}
+
+var listOptions = map[string]bool{"PREFIX": true, "SORT": true, "LIMIT": true, "OFFSET": true, "CURSOR": true, "FORMAT": true}
+
+// tells STATS <page> apart from STATS <option> ...
+func isListOption(word string) bool {
+	return listOptions[strings.ToUpper(word)]
+}
+
+func parseListQuery(args []string) (listQuery, error) {
+	q := listQuery{Sort: "name", Format: "text"}
+	if len(args)%2 != 0 {
+		return q, errors.New("every option needs a value")
+	}
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "PREFIX":
+			q.Prefix = value
+		case "SORT":
+			q.Sort = strings.ToLower(value)
+			if q.Sort != "name" && q.Sort != "hits" {
+				return q, fmt.Errorf("invalid sort %s", value)
+			}
+		case "LIMIT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid limit %s", value)
+			}
+			q.Limit = n
+		case "OFFSET":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid offset %s", value)
+			}
+			q.Offset = n
+		case "CURSOR":
+			q.Cursor = value
+		case "FORMAT":
+			q.Format = strings.ToLower(value)
+			if q.Format != "text" && q.Format != "json" && q.Format != "csv" {
+				return q, fmt.Errorf("invalid format %s", value)
+			}
+		default:
+			return q, fmt.Errorf("unknown option %s", args[i])
+		}
+	}
+	if q.Cursor != "" && q.Offset > 0 {
+		return q, errors.New("use either OFFSET or CURSOR")
+	}
+	return q, nil
+}
+
+// the cursor remembers the sort and the last row sent, the next page starts right after it
+// so pages created in between don't shift the listing like an offset would
+func encodeCursor(sortBy string, last pageStatsJSON) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s\x00%d\x00%s", sortBy, last.Hits, last.Page)))
+}
+
+func decodeCursor(sortBy, cursor string) (pageStatsJSON, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return pageStatsJSON{}, errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), "\x00", 3)
+	if len(parts) != 3 || parts[0] != sortBy {
+		return pageStatsJSON{}, errors.New("invalid cursor for this sort")
+	}
+	hits, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return pageStatsJSON{}, errors.New("invalid cursor")
+	}
+	return pageStatsJSON{Page: parts[2], Hits: hits}, nil
+}
+
+// order of the listing, hits from the most visited with the name breaking ties
+func listLess(sortBy string, a, b pageStatsJSON) bool {
+	if sortBy == "hits" && a.Hits != b.Hits {
+		return a.Hits > b.Hits
+	}
+	return a.Page < b.Page
+}
+
+// run a listing query, returns the rows and the cursor of the next page (empty on the last page)
+func (hcs *HitCounterServer) queryStats(q listQuery) ([]pageStatsJSON, string, error) {
+	// the counters are read without holding any shard lock
+	var rows []pageStatsJSON
+	hcs.pages.each(func(page *PageHit) bool {
+		if strings.HasPrefix(page.Name, q.Prefix) {
+			rows = append(rows, newPageStatsJSON(page))
+		}
+		return true
+	})
+	now := time.Now()
+	hcs.pages.eachEvicted(func(name string, e *evictedPage) bool {
+		if strings.HasPrefix(name, q.Prefix) {
+			rows = append(rows, e.stats(name, now))
+		}
+		return true
+	})
+	sort.Slice(rows, func(i, j int) bool { return listLess(q.Sort, rows[i], rows[j]) })
+
+	start := q.Offset
+	if q.Cursor != "" {
+		last, err := decodeCursor(q.Sort, q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start = sort.Search(len(rows), func(i int) bool { return listLess(q.Sort, last, rows[i]) })
+	}
+	if start > len(rows) {
+		start = len(rows)
+	}
+	rows = rows[start:]
+
+	next := ""
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+		next = encodeCursor(q.Sort, rows[len(rows)-1])
+	}
+	return rows, next, nil
+}
+
+// write the STATS listing in the requested format, the map lock is not held while writing
+func (hcs *HitCounterServer) listStats(conn net.Conn, args []string) {
+	q, err := parseListQuery(args)
+	if err != nil {
+		fmt.Fprintf(conn, "Invalid STATS: %v\n", err)
+		return
+	}
+	rows, next, err := hcs.queryStats(q)
+	if err != nil {
+		fmt.Fprintf(conn, "Invalid STATS: %v\n", err)
+		return
+	}
+
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+
+	switch q.Format {
+	case "json":
+		// a single line so line based clients read it in one go
+		json.NewEncoder(w).Encode(map[string]any{"pages": rows, "next_cursor": next, "memory": hcs.memoryStats()})
+		return
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(statsCSVHeader)
+		for _, r := range rows {
+			cw.Write(r.csvRow())
+		}
+		cw.Flush()
+	default:
+		for _, r := range rows {
+			fmt.Fprintf(w, "Site %s Hit %d Uniques %d\n", r.Page, r.Hits, r.Uniques)
+		}
+	}
+	if next != "" {
+		fmt.Fprintf(w, "Next cursor %s\n", next)
+		return
+	}
+	if q.Format == "text" {
+		// the listing ends with the memory of all the pages, including the ones not listed
+		m := hcs.memoryStats()
+		fmt.Fprintf(w, "Memory %d bytes", m.Used)
+		if m.Budget > 0 {
+			fmt.Fprintf(w, " of %d", m.Budget)
+		}
+		fmt.Fprintf(w, " Pages %d in memory %d on disk Evictions %d Reloads %d\n", m.Pages, m.Spilled, m.Evictions, m.Reloads)
+	}
+}
+
+// EXPORT json|csv streams every page, evicted ones included, one row per line
+// and ends with an empty line. rows are written as the shards are walked so the
+// map is never copied, which also means the export is not a snapshot
+func (hcs *HitCounterServer) exportPages(conn net.Conn, args []string) {
+	if len(args) != 1 || (args[0] != "json" && args[0] != "csv") {
+		fmt.Fprintf(conn, "Usage: EXPORT json|csv\n")
+		return
+	}
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	hcs.writeExport(w, args[0])
+	fmt.Fprintf(w, "\n")
+}
+
+// write every page as json lines or csv, returns how many were written
+func (hcs *HitCounterServer) writeExport(w io.Writer, format string) (int, error) {
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+		cw.Write(statsCSVHeader)
+	}
+	enc := json.NewEncoder(w)
+	n := 0
+	var err error
+	write := func(row pageStatsJSON) bool {
+		if cw != nil {
+			cw.Write(row.csvRow())
+			cw.Flush()
+			err = cw.Error()
+		} else {
+			err = enc.Encode(row)
+		}
+		n++
+		return err == nil
+	}
+	hcs.pages.each(func(page *PageHit) bool { return write(newPageStatsJSON(page)) })
+	if err == nil {
+		now := time.Now()
+		hcs.pages.eachEvicted(func(name string, e *evictedPage) bool { return write(e.stats(name, now)) })
+	}
+	return n, err
+}
+
+// a page read by IMPORT
+type importRow struct {
+	Page     string
+	Hits     uint64
+	Filtered uint64
+}
+
+// most rows one IMPORT over tcp may send, they are all held in memory until the end
+const maxImportRows = 1 << 20
+
+// read the rows of an import up to an empty line or the end of r. the format is
+// told by the first row: json lines like EXPORT json, or csv like EXPORT csv
+// (the header is optional, only the page and hits columns are needed).
+// after an error the rest is still read so the tcp client stays in sync.
+// with needEnd the end of r before the empty line is an error, a client that
+// disconnects halfway doesn't leave half an import behind. beforeLine, if set,
+// runs before every line is read (to move the read deadline of a connection)
+func readImport(r *bufio.Reader, needEnd bool, maxRows int, beforeLine func()) ([]importRow, error) {
+	var rows []importRow
+	var firstErr error
+	jsonRows := false
+	for lineNo := 1; ; lineNo++ {
+		if beforeLine != nil {
+			beforeLine()
+		}
+		line, err := r.ReadString('\n')
+		if err != nil && needEnd {
+			return nil, errors.New("the rows didn't end with an empty line")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return rows, firstErr
+		}
+		if lineNo == 1 {
+			jsonRows = strings.HasPrefix(line, "{")
+		}
+		if firstErr == nil {
+			row, skip, perr := parseImportRow(line, jsonRows, lineNo == 1)
+			switch {
+			case perr != nil:
+				firstErr = fmt.Errorf("line %d: %v", lineNo, perr)
+			case skip:
+			case maxRows > 0 && len(rows) >= maxRows:
+				firstErr = fmt.Errorf("more than %d rows", maxRows)
+				rows = nil
+			default:
+				rows = append(rows, row)
+			}
+		}
+		if err != nil {
+			return rows, firstErr
+		}
+	}
+}
+
+func parseImportRow(line string, jsonRow, first bool) (importRow, bool, error) {
+	if jsonRow {
+		var r pageStatsJSON
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return importRow{}, false, err
+		}
+		if r.Page == "" {
+			return importRow{}, false, errors.New("missing page")
+		}
+		return importRow{Page: r.Page, Hits: r.Hits, Filtered: r.Filtered}, false, nil
+	}
+
+	record, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return importRow{}, false, err
+	}
+	if first && record[0] == statsCSVHeader[0] {
+		return importRow{}, true, nil
+	}
+	if len(record) < 2 || record[0] == "" {
+		return importRow{}, false, errors.New("expected page,hits")
+	}
+	row := importRow{Page: record[0]}
+	if row.Hits, err = strconv.ParseUint(record[1], 10, 64); err != nil {
+		return importRow{}, false, fmt.Errorf("invalid hits %s", record[1])
+	}
+	if len(record) >= len(statsCSVHeader) {
+		if row.Filtered, err = strconv.ParseUint(record[len(statsCSVHeader)-1], 10, 64); err != nil {
+			return importRow{}, false, fmt.Errorf("invalid filtered %s", record[len(statsCSVHeader)-1])
+		}
+	}
+	return row, false, nil
+}
+
+// apply an import. merge adds the lifetime totals to this node's entry of the pages, replace sets them
+// like SET and deletes every page that is not in the import. the windows and unique
+// visitors of an export are only a report, they can't be rebuilt from a number
+func (hcs *HitCounterServer) importPages(rows []importRow, mode string) {
+	imported := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		// rows from before a canonicalization change land on the keys the hits use
+		name := hcs.canon.apply(row.Page)
+		if name == "" {
+			continue
+		}
+		// several rows can end up on the same key, replace only drops what was there before
+		replace := mode == "replace" && !imported[name]
+		imported[name] = true
+		hcs.updatePage(name, func(page *PageHit) {
+			if replace {
+				page.resetTo(row.Hits)
+				page.filtered.Store(row.Filtered)
+				return
+			}
+			// only our own G-counter entry grows, a new epoch would make every
+			// peer drop its entry with the hits it didn't sync yet
+			page.hit.Add(row.Hits)
+			page.filtered.Add(row.Filtered)
+		})
+	}
+	if mode != "replace" {
+		return
+	}
+
+	var stale []string
+	hcs.pages.each(func(page *PageHit) bool {
+		if !imported[page.Name] {
+			stale = append(stale, page.Name)
+		}
+		return true
+	})
+	hcs.pages.eachEvicted(func(name string, _ *evictedPage) bool {
+		if !imported[name] {
+			stale = append(stale, name)
+		}
+		return true
+	})
+	for _, name := range stale {
+		hcs.pages.remove(name)
+	}
+}
+
+// IMPORT merge|replace, followed by the rows and an empty line. it changes the
+// counts like SET so it needs AUTH. a refused import is skipped up to the empty
+// line without keeping the rows, so the tcp client stays in sync
+func (hcs *HitCounterServer) importCommand(conn *clientConn, r *bufio.Reader, args []string) {
+	// the whole import can take longer than one command, but every line must
+	// come within the read timeout
+	timeout := hcs.cfg.ReadTimeout
+	if timeout == 0 {
+		timeout = hcs.cfg.IdleTimeout
+	}
+	beforeLine := func() {
+		if timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+	}
+
+	if len(args) != 2 || (args[1] != "merge" && args[1] != "replace") {
+		skipImport(r, beforeLine)
+		fmt.Fprintf(conn, "Usage: IMPORT merge|replace, then the rows of EXPORT json or csv and an empty line\n")
+		return
+	}
+	if !conn.admin {
+		skipImport(r, beforeLine)
+		fmt.Fprintf(conn, "Admin command %s needs AUTH first\n", args[0])
+		return
+	}
+	rows, err := readImport(r, true, maxImportRows, beforeLine)
+	if err == nil {
+		hcs.importPages(rows, args[1])
+	}
+
+	entry := auditEntry{Time: time.Now(), Remote: conn.RemoteAddr().String(), Action: args[0], Args: []string{args[1], strconv.Itoa(len(rows)) + " pages"}, Result: "ok"}
+	if err != nil {
+		entry.Result = err.Error()
+	}
+	hcs.audit.record(entry)
+
+	if err != nil {
+		fmt.Fprintf(conn, "IMPORT failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "IMPORT %s done, %d pages\n", args[1], len(rows))
+}
+
+// read the lines of a refused import up to the empty line and throw them away,
+// a piece of a line at a time so even a very long one is never held in memory
+func skipImport(r *bufio.Reader, beforeLine func()) {
+	for {
+		beforeLine()
+		line, err := r.ReadSlice('\n')
+		long := false // more than a buffer, so not the empty line
+		for err == bufio.ErrBufferFull {
+			long = true
+			_, err = r.ReadSlice('\n')
+		}
+		if err != nil {
+			return
+		}
+		if !long && len(bytes.TrimSpace(line)) == 0 {
+			return
+		}
+	}
+}
+
+// import a file given at startup
+func (hcs *HitCounterServer) importFile(path, mode string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	rows, err := readImport(bufio.NewReader(f), false, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	hcs.importPages(rows, mode)
+	return len(rows), nil
+}
+
+// UNIQUES <page> shows the estimated unique visitors of the last hour, day and lifetime,
+// UNIQUES <page> WINDOW <duration> merges the hourly sketches of that window
+func (hcs *HitCounterServer) pageUniques(conn net.Conn, args []string) {
+	if len(args) != 1 && !(len(args) == 3 && strings.ToUpper(args[1]) == "WINDOW") {
+		fmt.Fprintf(conn, "Usage: UNIQUES <page> [WINDOW <duration>]\n")
+		return
+	}
+
+	page, ok := hcs.lookupPage(args[0])
+	if !ok {
+		fmt.Fprintf(conn, "Unknown page %s\n", args[0])
+		return
+	}
+
+	now := time.Now()
+	if len(args) == 3 {
+		d, err := time.ParseDuration(args[2])
+		if err != nil || d <= 0 {
+			fmt.Fprintf(conn, "Invalid window %s\n", args[2])
+			return
+		}
+		n, err := page.uniques.window(now, d)
+		if err != nil {
+			fmt.Fprintf(conn, "Invalid window: %v\n", err)
+			return
+		}
+		fmt.Fprintf(conn, "Site %s Uniques %d in last %s\n", page.Name, n, d)
+		return
+	}
+
+	hour, _ := page.uniques.window(now, time.Hour)
+	day, _ := page.uniques.window(now, 24*time.Hour)
+	fmt.Fprintf(conn, "Site %s Uniques %d (1h: %d, 24h: %d)\n", page.Name, page.uniques.total(), hour, day)
+}
+
+// TOP <k> lists the k most visited pages of all time, TOP <k> WINDOW <duration>
+// answers from the heavy hitter summaries so the map is never sorted
+func (hcs *HitCounterServer) topPages(conn net.Conn, args []string) {
+	if len(args) != 1 && !(len(args) == 3 && strings.ToUpper(args[1]) == "WINDOW") {
+		fmt.Fprintf(conn, "Usage: TOP <k> [WINDOW <duration>]\n")
+		return
+	}
+	k, err := strconv.Atoi(args[0])
+	if err != nil || k <= 0 {
+		fmt.Fprintf(conn, "Invalid k %s\n", args[0])
+		return
+	}
+
+	var top []rankedPage
+	if len(args) == 3 {
+		d, err := time.ParseDuration(args[2])
+		if err != nil || d <= 0 {
+			fmt.Fprintf(conn, "Invalid window %s\n", args[2])
+			return
+		}
+		if k > topCapacity {
+			fmt.Fprintf(conn, "k can't be bigger than %d with a window\n", topCapacity)
+			return
+		}
+		top, err = hcs.top.top(time.Now(), d, k)
+		if err != nil {
+			fmt.Fprintf(conn, "Invalid window: %v\n", err)
+			return
+		}
+		// the summaries still hold pages deleted or renamed by an admin until their buckets expire
+		live := top[:0]
+		for _, page := range top {
+			if _, ok := hcs.pages.peek(page.Name); ok {
+				live = append(live, page)
+			}
+		}
+		top = live
+	} else {
+		// lifetime totals are exact, a k sized heap avoids sorting every page
+		var h rankHeap
+		hcs.pages.each(func(page *PageHit) bool {
+			h.offer(rankedPage{Name: page.Name, Hits: page.total()}, k)
+			return true
+		})
+		hcs.pages.eachEvicted(func(name string, e *evictedPage) bool {
+			h.offer(rankedPage{Name: name, Hits: e.total()}, k)
+			return true
+		})
+		top = h.sorted()
+	}
+
+	for i, page := range top {
+		fmt.Fprintf(conn, "#%d Site %s Hit %d\n", i+1, page.Name, page.Hits)
+	}
+	if len(top) == 0 {
+		fmt.Fprintf(conn, "No hits\n")
+	}
+}
+
+// ip part of a client address, used as the visitor id when the client sends none
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// smallest transparent 1x1 gif, the body of the tracking pixel
+var trackingPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// json shape of a page in the http responses
+type pageStatsJSON struct {
+	Page       string `json:"page"`
+	Hits       uint64 `json:"hits"`
+	LastMinute uint64 `json:"last_minute"`
+	LastHour   uint64 `json:"last_hour"`
+	LastDay    uint64 `json:"last_day"`
+	Uniques    uint64 `json:"uniques"`
+	Filtered   uint64 `json:"filtered"`
+}
+
+// columns of the csv listing and export, in the order of csvRow
+var statsCSVHeader = []string{"page", "hits", "last_minute", "last_hour", "last_day", "uniques", "filtered"}
+
+func (r pageStatsJSON) csvRow() []string {
+	return []string{r.Page, strconv.FormatUint(r.Hits, 10), strconv.FormatUint(r.LastMinute, 10),
+		strconv.FormatUint(r.LastHour, 10), strconv.FormatUint(r.LastDay, 10), strconv.FormatUint(r.Uniques, 10),
+		strconv.FormatUint(r.Filtered, 10)}
+}
+
+func newPageStatsJSON(page *PageHit) pageStatsJSON {
+	minute, _ := page.windowHits(time.Minute)
+	hour, _ := page.windowHits(time.Hour)
+	day, _ := page.windowHits(24 * time.Hour)
+	return pageStatsJSON{
+		Page:       page.Name,
+		Hits:       page.total(),
+		LastMinute: minute,
+		LastHour:   hour,
+		LastDay:    day,
+		Uniques:    page.uniques.total(),
+		Filtered:   page.filtered.Load(),
+	}
+}
+
+// http listener that writes into the same pages as the tcp protocol
+func (hcs *HitCounterServer) runHTTP(ctx context.Context) {
+	defer hcs.wg.Done()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hit", hcs.handleHTTPHit)
+	mux.HandleFunc("/pixel.gif", hcs.handlePixel)
+	mux.HandleFunc("/stats", hcs.handleHTTPStats)
+
+	srv := &http.Server{Addr: hcs.cfg.HTTPAddr, Handler: mux, ReadHeaderTimeout: hcs.cfg.ReadTimeout, IdleTimeout: hcs.cfg.IdleTimeout}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		// requests in flight are answered, up to the shutdown timeout
+		sctx, cancel := context.WithTimeout(context.Background(), hcs.cfg.ShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+
+	fmt.Printf("Hit Counter HTTP listener started on %s\n", hcs.cfg.HTTPAddr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Println("HTTP Server Error:", err)
+		return
+	}
+	<-stopped
+}
+
+// headers browsers need to call us from another origin and to never cache a hit
+func (hcs *HitCounterServer) setHitHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", hcs.cfg.AllowOrigin)
+	h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Content-Type")
+	h.Set("Timing-Allow-Origin", hcs.cfg.AllowOrigin)
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
+	h.Set("Pragma", "no-cache")
+	h.Set("Expires", "0")
+}
+
+// visitor id from the v parameter or the client ip
+func httpVisitor(r *http.Request) string {
+	if v := r.URL.Query().Get("v"); v != "" {
+		return v
+	}
+	return hostOf(r.RemoteAddr)
+}
+
+func httpHitRequest(r *http.Request, name string) hitRequest {
+	tags := httpTags(r)
+	ua := tags["ua"]
+	if ua == "" {
+		ua = r.UserAgent()
+	}
+	return hitRequest{Page: name, Visitor: httpVisitor(r), Remote: hostOf(r.RemoteAddr), UA: ua, Tags: tags}
+}
+
+// parameters with a meaning of their own, every other parameter is a tag
+var reservedParams = map[string]bool{"page": true, "v": true, "cb": true}
+
+// tags from the query parameters, like /hit?page=/home&ref=google.com&country=et
+func httpTags(r *http.Request) map[string]string {
+	var tokens []string
+	for key, values := range r.URL.Query() {
+		if reservedParams[key] || len(values) == 0 || values[0] == "" {
+			continue
+		}
+		tokens = append(tokens, key+"="+values[0])
+	}
+	tags, _ := parseTags(tokens) // every token is a valid key=value here
+	return tags
+}
+
+// /hit?page=<page>[&v=<visitor>] records a hit and answers with the page totals
+func (hcs *HitCounterServer) handleHTTPHit(w http.ResponseWriter, r *http.Request) {
+	hcs.setHitHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("page"))
+	if name == "" {
+		http.Error(w, "missing page", http.StatusBadRequest)
+		return
+	}
+
+	page, total, err := hcs.recordHit(httpHitRequest(r, name))
+	// a page like #top or ?utm_source=x canonicalizes to nothing
+	if err == errInvalidHit {
+		http.Error(w, "invalid page", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err == errRateLimit {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	// a filtered hit on a page that doesn't exist has no page
+	pageName := hcs.canon.apply(name)
+	if page != nil {
+		pageName = page.Name
+	}
+	resp := map[string]any{"page": pageName, "hits": total}
+	if err != nil {
+		resp["filtered"] = err.Error()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// /pixel.gif?page=<page>[&v=<visitor>] for <img> tags. without a page the path of the
+// Referer is used. any other parameter (like a random cb=) only busts caches
+func (hcs *HitCounterServer) handlePixel(w http.ResponseWriter, r *http.Request) {
+	hcs.setHitHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("page"))
+	if name == "" {
+		if ref, err := url.Parse(r.Referer()); err == nil && ref.Path != "" {
+			name = ref.Path
+		}
+	}
+	// the image is served even without a page so the browser never shows a broken image
+	if name != "" {
+		hcs.recordHit(httpHitRequest(r, name))
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Length", fmt.Sprint(len(trackingPixel)))
+	w.Write(trackingPixel)
+}
+
+// /stats returns every page as json, /stats?page=<page> only that page
+func (hcs *HitCounterServer) handleHTTPStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", hcs.cfg.AllowOrigin)
+	w.Header().Set("Content-Type", "application/json")
+
+	if name := r.URL.Query().Get("page"); name != "" {
+		page, ok := hcs.lookupPage(name)
+		if !ok {
+			http.Error(w, "unknown page", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(newPageStatsJSON(page))
+		return
+	}
+
+	// same options as the STATS listing, the next cursor goes in a header to keep the body a plain array
+	params := r.URL.Query()
+	var args []string
+	for _, opt := range []string{"prefix", "sort", "limit", "offset", "cursor"} {
+		if v := params.Get(opt); v != "" {
+			args = append(args, opt, v)
+		}
+	}
+	q, err := parseListQuery(args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, next, err := hcs.queryStats(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+// one resolution of the history: rows of step long buckets, one file per period
+// (named after layout) and files older than retention are deleted
+type historyResolution struct {
+	name      string
+	step      time.Duration
+	layout    string                    // time layout of the file names
+	period    func(time.Time) time.Time // end of the period starting at t
+	retention time.Duration
+}
+
+// hits rolled up every minute into minute, hour and day buckets, stored as
+// tab separated rows "<unix time>\t<escaped page>\t<hits>" under dir/<resolution>/
+type historyStore struct {
+	dir         string
+	resolutions []historyResolution // from the finest to the coarsest
+
+	// used only by the rollup goroutine
+	last     map[string]rolledTotal // pages at the previous rollup, rebuilt each time so deleted pages drop out
+	lastRoll time.Time
+}
+
+// total of a page at a rollup and the epoch it was in
+type rolledTotal struct {
+	epoch uint64
+	total uint64
+}
+
+func newHistoryStore(cfg Config) *historyStore {
+	return &historyStore{
+		dir: cfg.HistoryDir,
+		resolutions: []historyResolution{
+			{name: "minute", step: time.Minute, layout: "2006-01-02", retention: cfg.MinuteRetention,
+				period: func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+			{name: "hour", step: time.Hour, layout: "2006-01", retention: cfg.HourRetention,
+				period: func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+			{name: "day", step: 24 * time.Hour, layout: "2006", retention: cfg.DayRetention,
+				period: func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+		},
+		last: make(map[string]rolledTotal),
+	}
+}
+
+func (h *historyStore) file(res historyResolution, t time.Time) string {
+	return filepath.Join(h.dir, res.name, t.UTC().Format(res.layout)+".tsv")
+}
+
+// append rows of one bucket to the file of its period
+func (h *historyStore) write(res historyResolution, at time.Time, counts map[string]uint64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	path := h.file(res, at)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for page, n := range counts {
+		fmt.Fprintf(w, "%d\t%s\t%d\n", at.Unix(), url.QueryEscape(page), n)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// call fn for every row of res in [from, to), page filters the rows when not empty
+func (h *historyStore) scan(res historyResolution, from, to time.Time, page string, fn func(at time.Time, page string, n uint64)) error {
+	for start := parseOrZero(res.layout, from.UTC().Format(res.layout)); start.Before(to); start = res.period(start) {
+		f, err := os.Open(h.file(res, start))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			parts := strings.Split(scanner.Text(), "\t")
+			if len(parts) != 3 {
+				continue
+			}
+			sec, err1 := strconv.ParseInt(parts[0], 10, 64)
+			n, err2 := strconv.ParseUint(parts[2], 10, 64)
+			name, err3 := url.QueryUnescape(parts[1])
+			if err1 != nil || err2 != nil || err3 != nil {
+				continue // a row cut by a crash
+			}
+			at := time.Unix(sec, 0)
+			if at.Before(from) || !at.Before(to) || (page != "" && name != page) {
+				continue
+			}
+			fn(at, name, n)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseOrZero(layout, value string) time.Time {
+	t, _ := time.Parse(layout, value)
+	return t
+}
+
+// sum the rows of the finer resolution over one bucket of res and append them
+func (h *historyStore) aggregate(res, finer historyResolution, start time.Time) error {
+	counts := make(map[string]uint64)
+	err := h.scan(finer, start, start.Add(res.step), "", func(_ time.Time, page string, n uint64) {
+		counts[page] += n
+	})
+	if err != nil {
+		return err
+	}
+	return h.write(res, start, counts)
+}
+
+// delete the files whose whole period is older than the retention
+func (h *historyStore) expire(now time.Time) {
+	for _, res := range h.resolutions {
+		if res.retention <= 0 {
+			continue
+		}
+		files, _ := filepath.Glob(filepath.Join(h.dir, res.name, "*.tsv"))
+		for _, file := range files {
+			start, err := time.Parse(res.layout, strings.TrimSuffix(filepath.Base(file), ".tsv"))
+			if err == nil && res.period(start).Before(now.Add(-res.retention)) {
+				os.Remove(file)
+			}
+		}
+	}
+}
+
+// write the hits of every page since the previous rollup as one minute bucket,
+// and close the hour and day buckets that ended since then
+func (hcs *HitCounterServer) rollup(now time.Time) {
+	h := hcs.history
+	counts := make(map[string]uint64)
+	next := make(map[string]rolledTotal, len(h.last))
+	count := func(name string, now rolledTotal) {
+		last, seen := h.last[name]
+		next[name] = now
+		switch {
+		case !seen && h.lastRoll.IsZero():
+			// first rollup since the start, only take the baseline
+		case seen && (now.epoch != last.epoch || now.total < last.total):
+			// SET, RESET or a newer epoch from a peer: the total was replaced,
+			// the difference is not hits so it only starts a new baseline
+		case now.total > last.total:
+			counts[name] = now.total - last.total
+		}
+	}
+	hcs.pages.each(func(page *PageHit) bool {
+		epoch, total := page.epochTotal()
+		count(page.Name, rolledTotal{epoch, total})
+		return true
+	})
+	// evicted pages get no hits, but gossip merged into their files raises them
+	hcs.pages.eachEvicted(func(name string, e *evictedPage) bool {
+		count(name, rolledTotal{e.epoch, e.total()})
+		return true
+	})
+	h.last = next
+
+	if !h.lastRoll.IsZero() {
+		minute, hour, day := h.resolutions[0], h.resolutions[1], h.resolutions[2]
+		bucket := h.lastRoll.Truncate(time.Minute)
+		if err := h.write(minute, bucket, counts); err != nil {
+			fmt.Println("History error:", err)
+		}
+		// buckets that ended between the previous rollup and now, rebuilt from
+		// the finer resolution on disk so a restart in the middle loses nothing
+		if start := h.lastRoll.Truncate(time.Hour); !now.Truncate(time.Hour).Equal(start) {
+			if err := h.aggregate(hour, minute, start); err != nil {
+				fmt.Println("History error:", err)
+			}
+		}
+		if start := h.lastRoll.Truncate(24 * time.Hour); !now.Truncate(24 * time.Hour).Equal(start) {
+			if err := h.aggregate(day, hour, start); err != nil {
+				fmt.Println("History error:", err)
+			}
+			h.expire(now)
+		}
+	}
+	h.lastRoll = now
+}
+
+// roll the hits up on every minute boundary
+func (hcs *HitCounterServer) runHistory(ctx context.Context) {
+	defer hcs.wg.Done()
+	hcs.history.expire(time.Now())
+	hcs.rollup(time.Now().UTC())
+	for {
+		now := time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+		hcs.rollup(time.Now().UTC())
+	}
+}
+
+// times of HISTORY: RFC 3339, unix seconds, "now" or a duration before now like -24h
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "now" {
+		return now, nil
+	}
+	if strings.HasPrefix(value, "-") {
+		d, err := time.ParseDuration(value[1:])
+		if err == nil {
+			return now.Add(-d), nil
+		}
+	}
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %s", value)
+	}
+	return t, nil
+}
+
+// most points HISTORY returns in one answer
+const maxHistoryPoints = 10000
+
+// pick the resolution for a query: the coarsest one that still divides the step
+// and whose retention reaches from, else the finest one that reaches from
+func (h *historyStore) pickResolution(from time.Time, step time.Duration, now time.Time) historyResolution {
+	covers := func(res historyResolution) bool {
+		return res.retention <= 0 || !from.Before(now.Add(-res.retention))
+	}
+	for i := len(h.resolutions) - 1; i >= 0; i-- {
+		res := h.resolutions[i]
+		if step >= res.step && step%res.step == 0 && covers(res) {
+			return res
+		}
+	}
+	for _, res := range h.resolutions {
+		if covers(res) {
+			return res
+		}
+	}
+	return h.resolutions[len(h.resolutions)-1]
+}
+
+// HISTORY <page> FROM <t1> TO <t2> STEP <d> answers one line per step with the hits of it
+func (hcs *HitCounterServer) pageHistory(conn net.Conn, args []string) {
+	if hcs.history == nil {
+		fmt.Fprintf(conn, "History is disabled, start the server with -history-dir\n")
+		return
+	}
+	if len(args) != 7 || strings.ToUpper(args[1]) != "FROM" || strings.ToUpper(args[3]) != "TO" || strings.ToUpper(args[5]) != "STEP" {
+		fmt.Fprintf(conn, "Usage: HISTORY <page> FROM <t1> TO <t2> STEP <duration>\n")
+		return
+	}
+
+	now := time.Now()
+	from, err1 := parseHistoryTime(args[2], now)
+	to, err2 := parseHistoryTime(args[4], now)
+	step, err3 := time.ParseDuration(args[6])
+	switch {
+	case err1 != nil:
+		fmt.Fprintf(conn, "Invalid HISTORY: %v\n", err1)
+		return
+	case err2 != nil:
+		fmt.Fprintf(conn, "Invalid HISTORY: %v\n", err2)
+		return
+	case err3 != nil || step < time.Minute:
+		fmt.Fprintf(conn, "Invalid HISTORY: step must be at least 1m\n")
+		return
+	case !from.Before(to):
+		fmt.Fprintf(conn, "Invalid HISTORY: FROM must be before TO\n")
+		return
+	}
+
+	res := hcs.history.pickResolution(from, step, now)
+	if step%res.step != 0 {
+		step = (step/res.step + 1) * res.step // steps are whole buckets of the resolution
+	}
+	from = from.UTC().Truncate(res.step)
+	points := int((to.Sub(from) + step - 1) / step)
+	if points > maxHistoryPoints {
+		fmt.Fprintf(conn, "Invalid HISTORY: %d points, at most %d\n", points, maxHistoryPoints)
+		return
+	}
+
+	series := make([]uint64, points)
+	err := hcs.history.scan(res, from, to, hcs.canon.apply(args[0]), func(at time.Time, _ string, n uint64) {
+		series[int(at.Sub(from)/step)] += n
+	})
+	if err != nil {
+		fmt.Fprintf(conn, "HISTORY failed: %v\n", err)
+		return
+	}
+
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	fmt.Fprintf(w, "History %s from %s step %s (%s resolution)\n", args[0], from.Format(time.RFC3339), step, res.name)
+	for i, n := range series {
+		fmt.Fprintf(w, "%s %d\n", from.Add(time.Duration(i)*step).Format(time.RFC3339), n)
+	}
+}
+
+// append only log of the admin actions, one json object per line
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"`
+	Action string    `json:"action"`
+	Args   []string  `json:"args,omitempty"`
+	Result string    `json:"result"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return &auditLog{f: f}, nil
+}
+
+func (a *auditLog) record(entry auditEntry) {
+	line, _ := json.Marshal(entry)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		fmt.Println("Audit log error:", err)
+	}
+}
+
+func (a *auditLog) Close() error {
+	return a.f.Close()
+}
+
+// commands that need AUTH first
+var adminCommands = map[string]bool{"RESET": true, "DELETE": true, "RENAME": true, "SET": true, "MIGRATE": true}
+
+// AUTH <token> turns the connection into an admin one, failures are audited too
+func (hcs *HitCounterServer) authenticate(conn *clientConn, token string) {
+	entry := auditEntry{Time: time.Now(), Remote: conn.RemoteAddr().String(), Action: "AUTH"}
+	if hcs.cfg.AdminToken == "" {
+		fmt.Fprintf(conn, "Admin commands are disabled\n")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(hcs.cfg.AdminToken)) != 1 {
+		entry.Result = "denied"
+		hcs.audit.record(entry)
+		fmt.Fprintf(conn, "Invalid token\n")
+		return
+	}
+	conn.admin = true
+	entry.Result = "ok"
+	hcs.audit.record(entry)
+	fmt.Fprintf(conn, "Authenticated\n")
+}
+
+// RESET <page>, DELETE <page>, RENAME <old> <new> and SET <page> <n>.
+// every attempt of an authenticated client ends up in the audit log
+func (hcs *HitCounterServer) adminCommand(conn *clientConn, args []string) {
+	if !conn.admin {
+		fmt.Fprintf(conn, "Admin command %s needs AUTH first\n", args[0])
+		return
+	}
+
+	err := hcs.runAdmin(args)
+	entry := auditEntry{Time: time.Now(), Remote: conn.RemoteAddr().String(), Action: args[0], Args: args[1:], Result: "ok"}
+	if err != nil {
+		entry.Result = err.Error()
+	}
+	hcs.audit.record(entry)
+
+	if err != nil {
+		fmt.Fprintf(conn, "%s failed: %v\n", args[0], err)
+		return
+	}
+	fmt.Fprintf(conn, "%s done\n", strings.Join(args, " "))
+}
+
+func (hcs *HitCounterServer) runAdmin(args []string) error {
+	switch args[0] {
+	case "RESET":
+		if len(args) != 2 {
+			return errors.New("usage: RESET <page>")
+		}
+		name := hcs.existingKey(args[1])
+		if _, ok := hcs.pages.get(name); !ok {
+			return fmt.Errorf("unknown page %s", args[1])
+		}
+		hcs.updatePage(name, func(page *PageHit) {
+			page.resetTo(0)
+			page.clearLocal()
+		})
+	case "SET":
+		if len(args) != 3 {
+			return errors.New("usage: SET <page> <n>")
+		}
+		n, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid count %s", args[2])
+		}
+		// a new key must be one the hits and STATS can reach
+		name := hcs.canon.apply(args[1])
+		if name == "" {
+			return fmt.Errorf("invalid page %s", args[1])
+		}
+		hcs.updatePage(name, func(page *PageHit) { page.resetTo(n) })
+	case "DELETE":
+		if len(args) != 2 {
+			return errors.New("usage: DELETE <page>")
+		}
+		if _, ok := hcs.pages.remove(hcs.existingKey(args[1])); !ok {
+			return fmt.Errorf("unknown page %s", args[1])
+		}
+	case "RENAME":
+		if len(args) != 3 {
+			return errors.New("usage: RENAME <old> <new>")
+		}
+		oldName, newName := hcs.existingKey(args[1]), hcs.canon.apply(args[2])
+		if newName == "" {
+			return fmt.Errorf("invalid page %s", args[2])
+		}
+		if oldName == newName {
+			return errors.New("old and new are the same page")
+		}
+		return hcs.renamePage(oldName, newName)
+	case "MIGRATE":
+		if len(args) != 1 {
+			return errors.New("usage: MIGRATE")
+		}
+		return hcs.migratePages()
+	}
+	return nil
+}
+
+// the key an admin command on an existing page works on: the canonical name, or the
+// name as typed when only that key exists, so keys stored before the canonicalization
+// rules changed can still be reset, deleted or renamed
+func (hcs *HitCounterServer) existingKey(name string) string {
+	key := hcs.canon.apply(name)
+	if key == name {
+		return key
+	}
+	if _, ok := hcs.pages.get(key); !ok {
+		if _, ok := hcs.pages.get(name); ok {
+			return name
+		}
+	}
+	return key
+}
+
+// merge every page whose key is not canonical under the current rules into
+// its canonical page, for the keys stored before the rules changed
+func (hcs *HitCounterServer) migratePages() error {
+	var stale []string
+	hcs.pages.each(func(page *PageHit) bool {
+		if hcs.canon.apply(page.Name) != page.Name {
+			stale = append(stale, page.Name)
+		}
+		return true
+	})
+	hcs.pages.eachEvicted(func(name string, _ *evictedPage) bool {
+		if hcs.canon.apply(name) != name {
+			stale = append(stale, name)
+		}
+		return true
+	})
+	for _, name := range stale {
+		if err := hcs.renamePage(name, hcs.canon.apply(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move every count of old into new (created if needed) and delete old
+func (hcs *HitCounterServer) renamePage(oldName, newName string) error {
+	old, ok := hcs.pages.remove(oldName)
+	if !ok {
+		return fmt.Errorf("unknown page %s", oldName)
+	}
+	hcs.updatePage(newName, func(page *PageHit) { page.absorb(old) })
+	return nil
+}
+
+// shortest WATCH interval, and how long push watchers wait to coalesce a burst of hits
+const (
+	minWatchInterval = 100 * time.Millisecond
+	watchCoalesce    = 100 * time.Millisecond
+)
+
+// a WATCH of a client: pushes the count deltas of a page, or of every page
+// under a prefix, on a ticker or right after hits
+type watcher struct {
+	target   string
+	prefix   bool          // target ended with * and matches every page starting with it
+	interval time.Duration // 0 pushes after every hit
+	conn     *clientConn
+	notify   chan struct{} // hits waiting to be pushed, buffered so recordHit never blocks
+	stop     chan struct{}
+	last     map[string]uint64 // totals sent last time
+}
+
+func (w *watcher) matches(name string) bool {
+	if w.prefix {
+		return strings.HasPrefix(name, w.target)
+	}
+	return name == w.target
+}
+
+// WATCH <page|prefix*> [interval], without an interval every hit is pushed (coalesced)
+func (hcs *HitCounterServer) watch(conn *clientConn, args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintf(conn, "Usage: WATCH <page|prefix*> [interval]\n")
+		return
+	}
+
+	// the pages are stored under their canonical names, so is the target
+	w := &watcher{
+		target: hcs.canon.apply(args[0]),
+		prefix: strings.HasSuffix(args[0], "*"),
+		conn:   conn,
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		last:   make(map[string]uint64),
+	}
+	if len(args) == 2 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d < minWatchInterval {
+			fmt.Fprintf(conn, "Invalid interval %s, it must be at least %s\n", args[1], minWatchInterval)
+			return
+		}
+		w.interval = d
+	}
+	if w.prefix {
+		w.target = hcs.canon.applyPrefix(strings.TrimSuffix(args[0], "*"))
+	}
+
+	// watching the same target again replaces the old watcher
+	hcs.unwatch(conn, args[0])
+	conn.watchers[args[0]] = w
+
+	hcs.watchMu.Lock()
+	hcs.watchers[w] = struct{}{}
+	hcs.watchMu.Unlock()
+	if w.interval == 0 {
+		hcs.pushWatchers.Add(1)
+	}
+
+	fmt.Fprintf(conn, "Watching %s\n", args[0])
+	go hcs.runWatcher(w)
+}
+
+// remove one watcher of the client, false if it wasn't watching target
+func (hcs *HitCounterServer) unwatch(conn *clientConn, target string) bool {
+	w, ok := conn.watchers[target]
+	if !ok {
+		return false
+	}
+	delete(conn.watchers, target)
+
+	hcs.watchMu.Lock()
+	delete(hcs.watchers, w)
+	hcs.watchMu.Unlock()
+	if w.interval == 0 {
+		hcs.pushWatchers.Add(-1)
+	}
+	close(w.stop)
+	return true
+}
+
+func (hcs *HitCounterServer) unwatchAll(conn *clientConn) {
+	for target := range conn.watchers {
+		hcs.unwatch(conn, target)
+	}
+}
+
+// wake the push watchers of a page that just got a hit
+func (hcs *HitCounterServer) notifyWatchers(name string) {
+	hcs.watchMu.RLock()
+	defer hcs.watchMu.RUnlock()
+	for w := range hcs.watchers {
+		if w.interval == 0 && w.matches(name) {
+			select {
+			case w.notify <- struct{}{}:
+			default: // a push is already pending, this hit is coalesced into it
+			}
+		}
+	}
+}
+
+func (hcs *HitCounterServer) runWatcher(w *watcher) {
+	hcs.pushDeltas(w, true) // start with the current totals
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-tick:
+		case <-w.notify:
+			// let a burst of hits land so it goes out as one delta
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(watchCoalesce):
+			}
+		}
+		if err := hcs.pushDeltas(w, false); err != nil {
+			return // the client is gone, handleClient cleans the registration
+		}
+	}
+}
+
+// write one line per watched page whose total changed since the last push
+func (hcs *HitCounterServer) pushDeltas(w *watcher, initial bool) error {
+	var pages []*PageHit
+	if w.prefix {
+		hcs.pages.each(func(page *PageHit) bool {
+			if w.matches(page.Name) {
+				pages = append(pages, page)
+			}
+			return true
+		})
+	} else if page, ok := hcs.pages.get(w.target); ok {
+		pages = append(pages, page)
+	}
+
+	for _, page := range pages {
+		total := page.total()
+		last := w.last[page.Name]
+		if !initial && total == last {
+			continue
+		}
+		w.last[page.Name] = total
+		change := fmt.Sprintf("+%d", total-last)
+		switch {
+		case initial:
+			change = "+0"
+		case total < last:
+			// a SET or RESET lowered the total, there is no delta of hits to show
+			change = "reset"
+		}
+		if _, err := fmt.Fprintf(w.conn, "Watch %s Hit %d (%s)\n", page.Name, total, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// an alert on the traffic of a page: the hits of a window or the rate of the last
+// minute compared to a threshold, like "/checkout HITS 5m < 10" or "/home RATE > 50"
+type alertRule struct {
+	Name      string
+	Page      string
+	Metric    string        // "hits" or "rate"
+	Window    time.Duration // of the hits metric
+	Op        string        // "<" or ">"
+	Threshold float64
+	For       time.Duration // how long the condition must hold before the alert fires
+
+	// state, only touched by the evaluator with the alerts lock held
+	pending time.Time // when the condition started to hold, zero when it doesn't
+	firing  bool
+	since   time.Time // when it fired
+}
+
+func (r *alertRule) String() string {
+	metric := "RATE"
+	if r.Metric == "hits" {
+		metric = "HITS " + r.Window.String()
+	}
+	s := fmt.Sprintf("%s %s %s %s %g", r.Name, r.Page, metric, r.Op, r.Threshold)
+	if r.For > 0 {
+		s += " FOR " + r.For.String()
+	}
+	return s
+}
+
+// ALERT ADD <name> <page> HITS <window> <op> <n> [FOR <d>] or
+// ALERT ADD <name> <page> RATE <op> <n> [FOR <d>]
+func parseAlertRule(args []string) (*alertRule, error) {
+	if len(args) < 5 {
+		return nil, errors.New("usage: ALERT ADD <name> <page> HITS <window> <|> <n> [FOR <d>] or ALERT ADD <name> <page> RATE <|> <n> [FOR <d>]")
+	}
+	r := &alertRule{Name: args[0], Page: args[1], Metric: strings.ToLower(args[2])}
+	rest := args[3:]
+	switch r.Metric {
+	case "hits":
+		d, err := time.ParseDuration(rest[0])
+		if err != nil || d <= 0 || d > maxWindow {
+			return nil, fmt.Errorf("invalid window %s, it must be between 1s and %s", rest[0], maxWindow)
+		}
+		r.Window, rest = d, rest[1:]
+	case "rate":
+	default:
+		return nil, fmt.Errorf("unknown metric %s, use HITS or RATE", args[2])
+	}
+	if len(rest) != 2 && !(len(rest) == 4 && strings.ToUpper(rest[2]) == "FOR") {
+		return nil, errors.New("expected <op> <n> [FOR <d>]")
+	}
+	if r.Op = rest[0]; r.Op != "<" && r.Op != ">" {
+		return nil, fmt.Errorf("invalid operator %s, use < or >", rest[0])
+	}
+	n, err := strconv.ParseFloat(rest[1], 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid threshold %s", rest[1])
+	}
+	r.Threshold = n
+	if len(rest) == 4 {
+		d, err := time.ParseDuration(rest[3])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration %s", rest[3])
+		}
+		r.For = d
+	}
+	return r, nil
+}
+
+// what a rule measures now, a page that was never hit has 0 of everything
+func (hcs *HitCounterServer) alertValue(r *alertRule) float64 {
+	page, ok := hcs.pages.peek(r.Page)
+	if !ok {
+		return 0
+	}
+	if r.Metric == "rate" {
+		return page.rate()
+	}
+	n, _ := page.windowHits(r.Window)
+	return float64(n)
+}
+
+// an alert starting or stopping, sent to the subscribers and the webhook
+type alertEvent struct {
+	Alert     string    `json:"alert"`
+	Status    string    `json:"status"` // "firing" or "resolved"
+	Page      string    `json:"page"`
+	Rule      string    `json:"rule"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+// events queued for the webhook, a slow webhook drops events instead of delaying the evaluation
+const webhookQueue = 256
+
+// a subscriber that falls this many lines behind, or takes longer than
+// subscriberWriteTimeout to take one, is dropped
+const (
+	subscriberQueue        = 64
+	subscriberWriteTimeout = 5 * time.Second
+)
+
+// rules, their subscribers and the webhook queue
+type alertManager struct {
+	mu    sync.Mutex
+	rules map[string]*alertRule
+	subs  map[*clientConn]chan string // clients that sent ALERT SUBSCRIBE, with their queued lines
+
+	webhook chan alertEvent // nil without a webhook url
 }
 
-// struct that keeps the data of pages and their hit
-type HitCounterServer struct {
-	pages map[string]*PageHit
-	mu    sync.Mutex     // this is used for the pages map to avoid race condition not PageHit hit which is atomic counter
-	wg    sync.WaitGroup // to keep track of goroutines
+func newAlertManager(cfg Config) *alertManager {
+	a := &alertManager{rules: make(map[string]*alertRule), subs: make(map[*clientConn]chan string)}
+	if cfg.AlertWebhook != "" {
+		a.webhook = make(chan alertEvent, webhookQueue)
+	}
+	return a
+}
+
+// ALERT ADD|DEL|LIST|SUBSCRIBE|UNSUBSCRIBE
+func (hcs *HitCounterServer) alertCommand(conn *clientConn, args []string) {
+	a := hcs.alerts
+	if len(args) == 0 {
+		fmt.Fprintf(conn, "Usage: ALERT ADD|DEL|LIST|SUBSCRIBE|UNSUBSCRIBE\n")
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "ADD":
+		r, err := parseAlertRule(args[1:])
+		if err != nil {
+			fmt.Fprintf(conn, "Invalid alert: %v\n", err)
+			return
+		}
+		r.Page = hcs.canon.apply(r.Page)
+		a.mu.Lock()
+		a.rules[r.Name] = r // replaces a rule with the same name
+		a.mu.Unlock()
+		fmt.Fprintf(conn, "Alert %s added\n", r)
+	case "DEL":
+		if len(args) != 2 {
+			fmt.Fprintf(conn, "Usage: ALERT DEL <name>\n")
+			return
+		}
+		a.mu.Lock()
+		_, ok := a.rules[args[1]]
+		delete(a.rules, args[1])
+		a.mu.Unlock()
+		if !ok {
+			fmt.Fprintf(conn, "Unknown alert %s\n", args[1])
+			return
+		}
+		fmt.Fprintf(conn, "Alert %s deleted\n", args[1])
+	case "LIST":
+		a.mu.Lock()
+		rules := make([]*alertRule, 0, len(a.rules))
+		for _, r := range a.rules {
+			rules = append(rules, r)
+		}
+		sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+		lines := make([]string, len(rules))
+		for i, r := range rules {
+			state := "ok"
+			if r.firing {
+				state = "firing since " + r.since.UTC().Format(time.RFC3339)
+			}
+			lines[i] = fmt.Sprintf("Alert %s %s\n", r, state)
+		}
+		a.mu.Unlock()
+		if len(lines) == 0 {
+			fmt.Fprintf(conn, "No alerts\n")
+		}
+		for _, line := range lines {
+			fmt.Fprint(conn, line)
+		}
+	case "SUBSCRIBE":
+		a.mu.Lock()
+		if _, ok := a.subs[conn]; !ok {
+			// each subscriber is written to by its own goroutine, so one that
+			// stops reading never holds up the evaluation
+			lines := make(chan string, subscriberQueue)
+			a.subs[conn] = lines
+			go a.writeSubscriber(conn, lines)
+		}
+		a.mu.Unlock()
+		fmt.Fprintf(conn, "Subscribed to alerts\n")
+	case "UNSUBSCRIBE":
+		a.unsubscribe(conn)
+		fmt.Fprintf(conn, "Unsubscribed from alerts\n")
+	default:
+		fmt.Fprintf(conn, "Unknown ALERT command %s\n", args[0])
+	}
+}
+
+func (a *alertManager) subscribed(conn *clientConn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.subs[conn]
+	return ok
+}
+
+// write the queued lines of a subscriber until it unsubscribes. the write deadline
+// keeps a client that doesn't read from holding its connection lock forever
+func (a *alertManager) writeSubscriber(conn *clientConn, lines chan string) {
+	for line := range lines {
+		conn.SetWriteDeadline(time.Now().Add(subscriberWriteTimeout))
+		_, err := fmt.Fprint(conn, line)
+		conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			fmt.Printf("Alert subscriber %s dropped: %v\n", conn.RemoteAddr(), err)
+			a.mu.Lock()
+			if a.subs[conn] == lines {
+				a.dropSubscriber(conn)
+			}
+			a.mu.Unlock()
+			return
+		}
+	}
+}
+
+// the alerts lock must be held
+func (a *alertManager) dropSubscriber(conn *clientConn) {
+	if lines, ok := a.subs[conn]; ok {
+		close(lines)
+		delete(a.subs, conn)
+	}
+}
+
+func (a *alertManager) unsubscribe(conn *clientConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.dropSubscriber(conn)
+}
+
+// evaluate every rule on a ticker
+func (hcs *HitCounterServer) runAlerts(ctx context.Context) {
+	ticker := time.NewTicker(hcs.cfg.AlertInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			hcs.evaluateAlerts(now)
+		}
+	}
+}
+
+// compare every rule to its page and send an event for the ones that start or stop firing
+func (hcs *HitCounterServer) evaluateAlerts(now time.Time) {
+	a := hcs.alerts
+	a.mu.Lock()
+	rules := make([]*alertRule, 0, len(a.rules))
+	for _, r := range a.rules {
+		rules = append(rules, r)
+	}
+	a.mu.Unlock()
+
+	// the pages are read without the alerts lock, a slow reload from disk doesn't block ALERT commands
+	values := make([]float64, len(rules))
+	for i, r := range rules {
+		values[i] = hcs.alertValue(r)
+	}
+
+	var events []alertEvent
+	a.mu.Lock()
+	for i, r := range rules {
+		if a.rules[r.Name] != r {
+			continue // deleted or replaced in the meantime
+		}
+		value := values[i]
+		holds := value < r.Threshold
+		if r.Op == ">" {
+			holds = value > r.Threshold
+		}
+		event := alertEvent{Alert: r.Name, Page: r.Page, Rule: r.String(), Value: value, Threshold: r.Threshold, Time: now}
+		switch {
+		case holds && !r.firing:
+			if r.pending.IsZero() {
+				r.pending = now
+			}
+			if now.Sub(r.pending) >= r.For {
+				r.firing, r.since = true, now
+				event.Status = "firing"
+				events = append(events, event)
+			}
+		case !holds:
+			r.pending = time.Time{}
+			if r.firing {
+				r.firing = false
+				event.Status = "resolved"
+				events = append(events, event)
+			}
+		}
+	}
+	// queue the lines of the subscribers under the lock so they are not closed in between.
+	// a subscriber whose queue is full stopped reading, it is dropped
+	for _, event := range events {
+		line := fmt.Sprintf("Alert %s %s value %g\n", strings.ToUpper(event.Status), event.Rule, event.Value)
+		for conn, lines := range a.subs {
+			select {
+			case lines <- line:
+			default:
+				fmt.Printf("Alert subscriber %s is not reading, dropped\n", conn.RemoteAddr())
+				a.dropSubscriber(conn)
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	for _, event := range events {
+		fmt.Printf("Alert %s %s (value %g)\n", event.Status, event.Rule, event.Value)
+		if a.webhook != nil {
+			select {
+			case a.webhook <- event:
+			default:
+				fmt.Println("Alert webhook queue is full, dropped", event.Alert, event.Status)
+			}
+		}
+	}
 }
 
-func NewHitCounterServer() *HitCounterServer {
-	return &HitCounterServer{
-		pages: make(map[string]*PageHit),
+// post the events to the webhook one at a time, in the order they happened, until ctx is done
+func (hcs *HitCounterServer) runWebhook(ctx context.Context) {
+	defer hcs.wg.Done()
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		var event alertEvent
+		select {
+		case <-ctx.Done():
+			return
+		case event = <-hcs.alerts.webhook:
+		}
+		var body bytes.Buffer
+		enc := json.NewEncoder(&body)
+		enc.SetEscapeHTML(false) // keep the < and > of the rules readable
+		if err := enc.Encode(event); err != nil {
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hcs.cfg.AlertWebhook, &body)
+		if err != nil {
+			fmt.Println("Alert webhook error:", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Println("Alert webhook error:", err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Println("Alert webhook error:", resp.Status)
+		}
 	}
 }
 
-func (hcs *HitCounterServer) Run() {
-	ln, err := net.Listen("tcp", ":8080")
+// read one RESP command: an array of bulk strings, or an inline command
+// (a plain line split on spaces, what telnet and redis-cli --no-raw can send)
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
 	if err != nil {
-		fmt.Println("Server Error:", err)
-		return
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
 	}
 
-	defer ln.Close()
-	fmt.Printf("Hit Counter Server started on :8080\n")
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > 1<<20 {
+		return nil, fmt.Errorf("invalid array length %q", line)
+	}
+	// the slice grows with the arguments that really arrive, the length alone
+	// doesn't get to allocate
+	var args []string
+	for i := 0; i < n; i++ {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		header = strings.TrimRight(header, "\r\n")
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("expected bulk string, got %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 || size > 1<<20 {
+			return nil, fmt.Errorf("invalid bulk length %q", header)
+		}
+		buf := make([]byte, size+2) // the data and its \r\n
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// writers of the RESP reply types
+func respSimple(w io.Writer, s string)   { fmt.Fprintf(w, "+%s\r\n", s) }
+func respError(w io.Writer, s string)    { fmt.Fprintf(w, "-ERR %s\r\n", s) }
+func respInt(w io.Writer, n uint64)      { fmt.Fprintf(w, ":%d\r\n", n) }
+func respBulk(w io.Writer, s string)     { fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s) }
+func respNil(w io.Writer)                { fmt.Fprintf(w, "$-1\r\n") }
+func respArrayHeader(w io.Writer, n int) { fmt.Fprintf(w, "*%d\r\n", n) }
+
+// listener of the redis protocol
+func (hcs *HitCounterServer) runRESP(ctx context.Context) {
+	defer hcs.wg.Done()
+	ln, err := net.Listen("tcp", hcs.cfg.RESPAddr)
+	if err != nil {
+		fmt.Println("RESP Server Error:", err)
+		return
+	}
+	fmt.Printf("Hit Counter RESP listener started on %s\n", hcs.cfg.RESPAddr)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			fmt.Println("Server Disconnected: ", err)
+			if ctx.Err() == nil {
+				fmt.Println("RESP Server Disconnected:", err)
+			}
 			return
 		}
 		hcs.wg.Add(1)
-		go hcs.handleClient(conn)
+		go hcs.handleRESP(conn)
 	}
 }
 
-func (hcs *HitCounterServer) handleClient(conn net.Conn) {
+// a page is a key: INCR/INCRBY record hits, GET/MGET read the totals and SCAN lists the pages
+func (hcs *HitCounterServer) handleRESP(conn net.Conn) {
 	defer hcs.wg.Done()
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn) // connect to the client to read their message
-	fmt.Fprintf(conn, "Send 'GET <page>' to record a hit, 'STATS' for totals, or 'exit' to quit:\n")
+	hcs.trackConn(conn, nil)
+	defer hcs.untrackConn(conn)
+
+	reader := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	remote := hostOf(conn.RemoteAddr().String())
 
 	for {
-		input, err := reader.ReadString('\n') // read client message
+		err := hcs.awaitCommand(conn, reader, true)
+		var args []string
+		if err == nil {
+			args, err = readRESPCommand(reader)
+		}
 		if err != nil {
-			fmt.Printf("Client %s Disconnected", conn.RemoteAddr().String())
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				respError(w, "Protocol error: "+err.Error())
+				w.Flush()
+			}
 			return
 		}
+		if len(args) == 0 {
+			continue
+		}
 
-		cmd := strings.TrimSpace(input)
-		if cmd == "exit" {
-			fmt.Printf("Client %s exited\n", conn.RemoteAddr().String())
+		if !hcs.respCommand(w, remote, args) {
+			w.Flush()
 			return
 		}
+		// pipelined commands are answered in one write once the reader is drained
+		if reader.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
 
-		if cmd == "STATS" {
-			hcs.mu.Lock()
-			for _, page := range hcs.pages {
-				fmt.Fprintf(conn, "Site %s Hit %d\n", page.Name, page.hit.Load())
+// run one RESP command, false when the connection should close
+func (hcs *HitCounterServer) respCommand(w io.Writer, remote string, args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "PING":
+		if len(args) > 1 {
+			respBulk(w, args[1])
+		} else {
+			respSimple(w, "PONG")
+		}
+	case "ECHO":
+		if len(args) != 2 {
+			respError(w, "wrong number of arguments for 'echo' command")
+			break
+		}
+		respBulk(w, args[1])
+	case "QUIT":
+		respSimple(w, "OK")
+		return false
+	case "SELECT", "CLIENT":
+		respSimple(w, "OK") // one database, and client names are not tracked
+	case "COMMAND":
+		respArrayHeader(w, 0) // redis-cli asks for the command docs on start
+	case "INCR", "INCRBY":
+		if (cmd == "INCR" && len(args) != 2) || (cmd == "INCRBY" && len(args) != 3) {
+			respError(w, fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+			break
+		}
+		n := uint64(1)
+		if cmd == "INCRBY" {
+			v, err := strconv.ParseUint(args[2], 10, 64)
+			if err != nil || v == 0 {
+				respError(w, "value is not a positive integer or out of range")
+				break
 			}
-			hcs.mu.Unlock()
-			continue
+			n = v
+		}
+		_, total, err := hcs.recordHit(hitRequest{Page: args[1], Visitor: remote, Remote: remote, Count: n, Aggregate: true})
+		if err == errInvalidHit {
+			respError(w, err.Error())
+			break
+		}
+		respInt(w, total) // filtered hits still answer the current total, like redis would
+	case "GET":
+		if len(args) != 2 {
+			respError(w, "wrong number of arguments for 'get' command")
+			break
+		}
+		hcs.respPageTotal(w, args[1])
+	case "MGET":
+		if len(args) < 2 {
+			respError(w, "wrong number of arguments for 'mget' command")
+			break
+		}
+		respArrayHeader(w, len(args)-1)
+		for _, key := range args[1:] {
+			hcs.respPageTotal(w, key)
 		}
+	case "EXISTS":
+		var n uint64
+		for _, key := range args[1:] {
+			if _, ok := hcs.lookupPage(key); ok {
+				n++
+			}
+		}
+		respInt(w, n)
+	case "DBSIZE":
+		respInt(w, uint64(hcs.pages.count()))
+	case "SCAN":
+		hcs.respScan(w, args[1:])
+	default:
+		respError(w, fmt.Sprintf("unknown command '%s'", args[0]))
+	}
+	return true
+}
 
-		// check if client wants to visite website
-		if strings.HasPrefix(cmd, "GET ") {
-			ph := strings.TrimSpace(strings.TrimPrefix(cmd, "GET ")) // parse the website name
-			if ph == "" {
-				fmt.Fprintf(conn, "Invalid Page\n")
-				continue
+// compile a redis glob (* ? [abc] and \ escapes) to a regexp. unlike path.Match
+// a * also matches /, which every page name has
+func redisGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unclosed [")
 			}
+			b.WriteString(pattern[i : i+end+1]) // classes mean the same in both syntaxes
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
 
-			page := hcs.getOrCreatePage(ph) // check if page exists and return page data
-			page.hit.Add(1)
-			fmt.Printf("Recorded hit for %s from %s (total: %d)\n", page.Name, conn.RemoteAddr().String(), page.hit.Load())
-			fmt.Fprintf(conn, "Hit recorded for %s\n", page.Name)
-			continue
+// total of a page as a bulk string, nil when the page doesn't exist
+func (hcs *HitCounterServer) respPageTotal(w io.Writer, key string) {
+	page, ok := hcs.lookupPage(key)
+	if !ok {
+		respNil(w)
+		return
+	}
+	respBulk(w, strconv.FormatUint(page.total(), 10))
+}
+
+// SCAN <cursor> [MATCH <pattern>] [COUNT <n>]. the cursor walks the scan index of
+// the page store, so a page that exists for the whole scan is returned exactly
+// once whatever is added or deleted in between, and a call only reads COUNT pages.
+// like redis, MATCH filters the pages after they are read
+func (hcs *HitCounterServer) respScan(w io.Writer, args []string) {
+	if len(args) == 0 {
+		respError(w, "wrong number of arguments for 'scan' command")
+		return
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		respError(w, "invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			respError(w, "syntax error")
+			return
 		}
-		fmt.Fprintf(conn, "Unknown command: %s\n", cmd)
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				respError(w, "value is not an integer or out of range")
+				return
+			}
+		case "TYPE":
+			// every key is a string
+		default:
+			respError(w, "syntax error")
+			return
+		}
+	}
+
+	match, err := redisGlob(pattern)
+	if err != nil {
+		respError(w, "invalid pattern")
+		return
+	}
+	names, next := hcs.pages.scan(cursor, count)
+	var keys []string
+	for _, name := range names {
+		if match.MatchString(name) {
+			keys = append(keys, name)
+		}
+	}
+
+	respArrayHeader(w, 2)
+	respBulk(w, strconv.FormatUint(next, 10))
+	respArrayHeader(w, len(keys))
+	for _, key := range keys {
+		respBulk(w, key)
+	}
+}
+
+// one gossip exchange: the full G-counter state of the sender
+type gossipMessage struct {
+	Node    string                `json:"node"`
+	Pages   map[string]gossipPage `json:"pages"`
+	Deleted map[string]uint64     `json:"deleted,omitempty"` // tombstones, page -> epoch
+}
+
+// G-counter of one page in a gossip message
+type gossipPage struct {
+	Epoch  uint64            `json:"epoch,omitempty"`
+	Counts map[string]uint64 `json:"counts"` // node -> count
+}
+
+// how long a single exchange with a peer may take
+const gossipTimeout = 5 * time.Second
+
+func (hcs *HitCounterServer) gossipState() gossipMessage {
+	msg := gossipMessage{Node: hcs.cfg.NodeID, Pages: make(map[string]gossipPage), Deleted: hcs.pages.tombstones()}
+	hcs.pages.each(func(page *PageHit) bool {
+		epoch, counts := page.counters(hcs.cfg.NodeID)
+		msg.Pages[page.Name] = gossipPage{Epoch: epoch, Counts: counts}
+		return true
+	})
+	hcs.pages.eachEvicted(func(name string, e *evictedPage) bool {
+		epoch, counts := e.counters(hcs.cfg.NodeID)
+		msg.Pages[name] = gossipPage{Epoch: epoch, Counts: counts}
+		return true
+	})
+	return msg
+}
+
+func (hcs *HitCounterServer) mergeGossip(msg gossipMessage) {
+	for name, epoch := range msg.Deleted {
+		hcs.pages.bury(name, epoch)
+	}
+	for name, gp := range msg.Pages {
+		if hcs.pages.buried(name, gp.Epoch) {
+			continue // deleted here after the peer's last change
+		}
+		changed := hcs.pages.mergeCounters(name, hcs.cfg.NodeID, gp.Epoch, gp.Counts)
+		if changed && hcs.pushWatchers.Load() > 0 {
+			hcs.notifyWatchers(name)
+		}
+	}
+}
+
+// anti-entropy: answer the peers that sync with us and sync with a random peer
+// every interval. each exchange is push-pull so both sides converge after it,
+// which also repairs everything a partition missed once it heals
+func (hcs *HitCounterServer) runGossip(ctx context.Context) {
+	defer hcs.wg.Done()
+	ln, err := net.Listen("tcp", hcs.cfg.GossipAddr)
+	if err != nil {
+		fmt.Println("Gossip Error:", err)
+		return
+	}
+	fmt.Printf("Gossip listener of node %s started on %s with %d peers\n", hcs.cfg.NodeID, hcs.cfg.GossipAddr, len(hcs.peers))
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	// an exchange merges into the pages, so the shutdown waits for it. it is
+	// bounded by gossipTimeout
+	hcs.wg.Add(1)
+	go func() {
+		defer hcs.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Println("Gossip listener stopped:", err)
+				}
+				return
+			}
+			hcs.wg.Add(1)
+			go hcs.handleGossip(conn)
+		}
+	}()
+
+	if len(hcs.peers) == 0 {
+		return
+	}
+	ticker := time.NewTicker(hcs.cfg.GossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		peer := hcs.peers[rand.Intn(len(hcs.peers))]
+		err := hcs.syncWith(peer.Addr)
+		hcs.peersMu.Lock()
+		peer.LastErr = err
+		if err == nil {
+			peer.LastSync = time.Now()
+		}
+		hcs.peersMu.Unlock()
 	}
 }
 
-func (hcs *HitCounterServer) getOrCreatePage(page string) *PageHit {
-	hcs.mu.Lock()
-	defer hcs.mu.Unlock()
+// a peer pushes its state, we merge it and answer with ours
+func (hcs *HitCounterServer) handleGossip(conn net.Conn) {
+	defer hcs.wg.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(gossipTimeout))
 
-	if pg, exists := hcs.pages[page]; exists {
-		return pg // return existed page if their
+	var msg gossipMessage
+	if err := json.NewDecoder(conn).Decode(&msg); err != nil {
+		fmt.Printf("Gossip from %s failed: %v\n", conn.RemoteAddr().String(), err)
+		return
 	}
+	hcs.mergeGossip(msg)
+	json.NewEncoder(conn).Encode(hcs.gossipState())
+}
 
-	pg := &PageHit{Name: page} // create new page and return it's data
-	hcs.pages[page] = pg
-	return pg
+// push our state to a peer and merge its answer
+func (hcs *HitCounterServer) syncWith(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, gossipTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(gossipTimeout))
+
+	if err := json.NewEncoder(conn).Encode(hcs.gossipState()); err != nil {
+		return err
+	}
+	var reply gossipMessage
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return err
+	}
+	hcs.mergeGossip(reply)
+	return nil
+}
+
+// PEERS shows this node and when each peer was last synced
+func (hcs *HitCounterServer) listPeers(conn net.Conn) {
+	fmt.Fprintf(conn, "Node %s\n", hcs.cfg.NodeID)
+	hcs.peersMu.Lock()
+	defer hcs.peersMu.Unlock()
+	for _, peer := range hcs.peers {
+		switch {
+		case peer.LastErr != nil:
+			fmt.Fprintf(conn, "Peer %s Error %v\n", peer.Addr, peer.LastErr)
+		case peer.LastSync.IsZero():
+			fmt.Fprintf(conn, "Peer %s never synced\n", peer.Addr)
+		default:
+			fmt.Fprintf(conn, "Peer %s synced %s ago\n", peer.Addr, time.Since(peer.LastSync).Round(time.Second))
+		}
+	}
+}
+
+// biggest udp datagram, statsd clients batch many lines into one
+const maxDatagram = 65535
+
+// statsd over udp for apps that send too many hits to wait for an answer to each.
+// a datagram holds one or more lines of counters, see parseStatsD
+func (hcs *HitCounterServer) runStatsD(ctx context.Context) {
+	defer hcs.wg.Done()
+	conn, err := net.ListenPacket("udp", hcs.cfg.StatsDAddr)
+	if err != nil {
+		fmt.Println("StatsD Server Error:", err)
+		return
+	}
+	defer conn.Close()
+	fmt.Printf("Hit Counter StatsD listener started on %s\n", hcs.cfg.StatsDAddr)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("StatsD Server Disconnected:", err)
+			}
+			return
+		}
+		remote := hostOf(addr.String())
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			hits, err := parseStatsD(line)
+			if err != nil {
+				fmt.Printf("Invalid StatsD line from %s: %v\n", remote, err)
+				continue
+			}
+			for _, req := range hits {
+				req.Visitor, req.Remote = remote, remote
+				hcs.recordHit(req)
+			}
+		}
+	}
+}
+
+// parse one statsd line into hits. counters look like page:1|c, with an optional
+// sample rate (page:1|c|@0.1 counts 10 hits) and dogstatsd tags (page:1|c|#ref:google.com).
+// several values of the same page can share a line, page:1|c:2|c, when there are no tags.
+// lines of other metric types (timers, gauges, sets) are skipped
+func parseStatsD(line string) ([]hitRequest, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, nil
+	}
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid metric %q", line)
+	}
+
+	// tags use : themselves so a tagged line holds a single value
+	samples := []string{rest}
+	if !strings.Contains(rest, "|#") {
+		samples = strings.Split(rest, ":")
+	}
+
+	var hits []hitRequest
+	for _, sample := range samples {
+		parts := strings.Split(sample, "|")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid sample %q", sample)
+		}
+		if parts[1] != "c" {
+			continue
+		}
+		value, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("invalid count %q", parts[0])
+		}
+
+		rate := 1.0
+		var tags map[string]string
+		for _, field := range parts[2:] {
+			switch {
+			case strings.HasPrefix(field, "@"):
+				rate, err = strconv.ParseFloat(field[1:], 64)
+				if err != nil || rate <= 0 || rate > 1 {
+					return nil, fmt.Errorf("invalid sample rate %q", field)
+				}
+			case strings.HasPrefix(field, "#"):
+				// key:value,key:value become the same tags as GET key=value
+				var tokens []string
+				for _, tag := range strings.Split(field[1:], ",") {
+					tokens = append(tokens, strings.Replace(tag, ":", "=", 1))
+				}
+				if tags, err = parseTags(tokens); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("invalid field %q", field)
+			}
+		}
+
+		// a sampled counter stands for 1/rate times its value
+		if n := uint64(math.Round(value / rate)); n > 0 {
+			hits = append(hits, hitRequest{Page: name, Tags: tags, Count: n, Aggregate: true})
+		}
+	}
+	return hits, nil
 }
 
 func main() {
-	server := NewHitCounterServer()
-	server.Run()
+	var cfg Config
+	flag.StringVar(&cfg.Addr, "addr", ":8080", "address of the tcp protocol")
+	flag.StringVar(&cfg.HTTPAddr, "http", "", "address of the http listener (empty to disable)")
+	flag.StringVar(&cfg.RESPAddr, "resp", "", "address of the redis protocol (empty to disable)")
+	flag.StringVar(&cfg.StatsDAddr, "statsd", "", "udp address of the statsd listener (empty to disable)")
+	normalize := flag.String("normalize", "", "comma separated canonicalization steps of page names, e.g. "+strings.Join(canonicalSteps, ",")+" (empty to count names as sent)")
+	tracking := flag.String("tracking-params", "utm_*,fbclid,gclid,msclkid,mc_cid,mc_eid,_ga,ref_src", "comma separated query parameters dropped from page names, name or prefix*")
+	aliases := flag.String("alias", "", "comma separated from=to rules applied to canonical page names, e.g. /index.html=/")
+	flag.StringVar(&cfg.AllowOrigin, "allow-origin", "*", "Access-Control-Allow-Origin of the http endpoints")
+	flag.StringVar(&cfg.NodeID, "node", "", "name of this node in the cluster (default <hostname><addr>)")
+	flag.StringVar(&cfg.GossipAddr, "gossip", "", "address where peers sync counters with us (empty to disable)")
+	peers := flag.String("peers", "", "comma separated gossip addresses of the other nodes")
+	flag.DurationVar(&cfg.GossipInterval, "gossip-interval", 2*time.Second, "how often to sync with a random peer")
+	denyUA := flag.String("deny-ua", "", "comma separated user agent fragments of bots whose hits are dropped, e.g. bot,crawler,spider (empty to disable)")
+	flag.Float64Var(&cfg.IPRate, "ip-rate", 0, "hits per second allowed per sender address (0 to disable)")
+	flag.Float64Var(&cfg.VisitorRate, "visitor-rate", 0, "hits per second allowed per visitor (0 to disable)")
+	flag.IntVar(&cfg.RateBurst, "rate-burst", 20, "hits a sender or visitor can send at once before the rate applies")
+	flag.DurationVar(&cfg.DedupWindow, "dedup", 0, "count a visitor hitting the same page within this window once (0 to disable)")
+	flag.DurationVar(&cfg.AlertInterval, "alert-interval", 10*time.Second, "how often the alert rules are evaluated")
+	flag.StringVar(&cfg.AlertWebhook, "alert-webhook", "", "url the alert events are posted to as json (empty to disable)")
+	maxMemory := flag.String("max-memory", "0", "estimated memory the pages may use before cold ones are evicted to disk, e.g. 64M (0 to disable)")
+	flag.StringVar(&cfg.EvictPolicy, "evict", "lru", "how cold pages are picked: lru or lfu")
+	flag.StringVar(&cfg.SpillDir, "spill-dir", "hit_counter_spill", "directory where evicted pages are written")
+	flag.StringVar(&cfg.StateFile, "state-file", "", "file every page is saved to on shutdown and loaded from at startup (empty to disable)")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long the shutdown waits for the connections to finish")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", 5*time.Minute, "how long a connection may wait between commands (0 to disable)")
+	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", 30*time.Second, "how long a client may take to send a command once it started (0 to disable)")
+	flag.StringVar(&cfg.ImportFile, "import", "", "file of EXPORT json or csv rows loaded at startup (empty to disable)")
+	flag.StringVar(&cfg.ImportMode, "import-mode", "merge", "how -import is applied: merge adds the counts, replace sets them and deletes the other pages")
+	flag.StringVar(&cfg.HistoryDir, "history-dir", "", "directory of the hit history (empty to disable)")
+	flag.DurationVar(&cfg.MinuteRetention, "history-minute-retention", 7*24*time.Hour, "how long minute buckets are kept")
+	flag.DurationVar(&cfg.HourRetention, "history-hour-retention", 90*24*time.Hour, "how long hour buckets are kept")
+	flag.DurationVar(&cfg.DayRetention, "history-day-retention", 2*365*24*time.Hour, "how long day buckets are kept (0 keeps them forever)")
+	flag.StringVar(&cfg.AuditLog, "audit-log", "hit_counter_audit.log", "file where admin actions are appended")
+	flag.Parse()
+
+	// the admin token is a secret so it is read from the environment, not a flag
+	cfg.AdminToken = os.Getenv("HIT_COUNTER_ADMIN_TOKEN")
+	if cfg.NodeID == "" {
+		host, _ := os.Hostname()
+		cfg.NodeID = host + cfg.Addr
+	}
+	cfg.DenyUA = strings.Split(*denyUA, ",")
+	budget, err := parseSize(*maxMemory)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	cfg.MemoryBudget = budget
+	if cfg.ImportMode != "merge" && cfg.ImportMode != "replace" {
+		fmt.Printf("Invalid -import-mode %s, use merge or replace\n", cfg.ImportMode)
+		return
+	}
+	if cfg.AlertInterval <= 0 {
+		fmt.Println("-alert-interval must be positive")
+		return
+	}
+	if cfg.EvictPolicy != "lru" && cfg.EvictPolicy != "lfu" {
+		fmt.Printf("Invalid -evict %s, use lru or lfu\n", cfg.EvictPolicy)
+		return
+	}
+	cfg.Normalize = strings.Split(*normalize, ",")
+	if unknown := unknownSteps(cfg.Normalize); len(unknown) > 0 {
+		fmt.Printf("Unknown -normalize steps %v, valid steps are %v\n", unknown, canonicalSteps)
+		return
+	}
+	cfg.TrackingParams = strings.Split(*tracking, ",")
+	cfg.Aliases = make(map[string]string)
+	for _, rule := range strings.Split(*aliases, ",") {
+		if from, to, ok := strings.Cut(strings.TrimSpace(rule), "="); ok {
+			cfg.Aliases[from] = to
+		}
+	}
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			cfg.Peers = append(cfg.Peers, peer)
+		}
+	}
+
+	// ctrl-c or a SIGTERM from the service manager shuts the server down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := NewHitCounterServer(cfg)
+	server.Run(ctx)
 }
@@ -0,0 +1,1360 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testConfig() Config {
+	return Config{
+		Normalize:      canonicalSteps,
+		TrackingParams: []string{"utm_*", "fbclid"},
+		EvictPolicy:    "lru",
+	}
+}
+
+// pages that canonicalize to nothing are rejected instead of crashing the handler
+func TestHTTPHitCanonicalEmpty(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	for _, page := range []string{"%23top", "%3Futm_source%3Dx"} {
+		rec := httptest.NewRecorder()
+		hcs.handleHTTPHit(rec, httptest.NewRequest(http.MethodGet, "/hit?page="+page, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("page %s: status %d, want %d", page, rec.Code, http.StatusBadRequest)
+		}
+		if !strings.Contains(rec.Body.String(), "invalid page") {
+			t.Errorf("page %s: body %q", page, rec.Body.String())
+		}
+	}
+	if n := hcs.pages.len(); n != 0 {
+		t.Errorf("%d pages created, want none", n)
+	}
+}
+
+// counters summed by the sender are not duplicates of each other
+func TestAggregateHitsSkipDedup(t *testing.T) {
+	cfg := testConfig()
+	cfg.DedupWindow = time.Minute
+	hcs := NewHitCounterServer(cfg)
+
+	hits, err := parseStatsD("/home:100|c")
+	if err != nil || len(hits) != 1 {
+		t.Fatalf("parseStatsD: %v %v", hits, err)
+	}
+	for i := 0; i < 2; i++ {
+		req := hits[0]
+		req.Visitor, req.Remote = "10.0.0.1", "10.0.0.1"
+		if _, _, err := hcs.recordHit(req); err != nil {
+			t.Fatalf("statsd hit %d: %v", i, err)
+		}
+	}
+	page, _ := hcs.lookupPage("/home")
+	if total := page.total(); total != 200 {
+		t.Errorf("total %d, want 200", total)
+	}
+
+	// a person hitting the same page twice is still a duplicate
+	req := hitRequest{Page: "/about", Visitor: "v1", Remote: "10.0.0.2"}
+	hcs.recordHit(req)
+	if _, _, err := hcs.recordHit(req); err != errDuplicate {
+		t.Errorf("second hit of a visitor: %v, want %v", err, errDuplicate)
+	}
+}
+
+// a denied crawler doesn't create pages, only the filtered count of existing ones grows
+func TestFilteredHitsDontCreatePages(t *testing.T) {
+	cfg := testConfig()
+	cfg.DenyUA = []string{"badbot"}
+	hcs := NewHitCounterServer(cfg)
+
+	hcs.recordHit(hitRequest{Page: "/known", Visitor: "v1"})
+	for _, name := range []string{"/random1", "/random2", "/known"} {
+		if _, _, err := hcs.recordHit(hitRequest{Page: name, Visitor: "crawler", UA: "BadBot/1.0"}); err != errBotHit {
+			t.Fatalf("hit of %s: %v, want %v", name, err, errBotHit)
+		}
+	}
+	if n := hcs.pages.len(); n != 1 {
+		t.Errorf("%d pages, want 1", n)
+	}
+	page, _ := hcs.lookupPage("/known")
+	if page.total() != 1 || page.filtered.Load() != 1 {
+		t.Errorf("/known total %d filtered %d, want 1 and 1", page.total(), page.filtered.Load())
+	}
+	if n := hcs.filter.stats.bots.Load(); n != 3 {
+		t.Errorf("%d bot hits counted, want 3", n)
+	}
+}
+
+// evicted pages still show up in the listing, and reading them for an alert
+// leaves them on disk
+func TestEvictedPagesListedNotReloaded(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	spill, err := openSpillStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcs.pages.spill = spill
+
+	for _, name := range []string{"/cold", "/hot"} {
+		hcs.recordHit(hitRequest{Page: name, Visitor: "v1"})
+	}
+	cold, _ := hcs.lookupPage("/cold")
+	if !hcs.pages.evict(cold) {
+		t.Fatal("/cold not evicted")
+	}
+
+	rows, _, err := hcs.queryStats(listQuery{Sort: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Page != "/cold" || rows[0].Hits != 1 {
+		t.Errorf("stats %+v, want /cold and /hot", rows)
+	}
+
+	rule := &alertRule{Page: "/cold", Metric: "hits", Window: time.Minute}
+	if v := hcs.alertValue(rule); v != 1 {
+		t.Errorf("alert value %v, want 1", v)
+	}
+	if n := hcs.pages.len(); n != 1 {
+		t.Errorf("%d pages in memory, want 1", n)
+	}
+	if n := hcs.pages.reloads.Load(); n != 0 {
+		t.Errorf("%d reloads, want 0", n)
+	}
+}
+
+// page map guarded by one mutex, the design before the sharded store,
+// kept here to compare the sharded store against it
+type lockedStore struct {
+	mu    sync.Mutex
+	pages map[string]*PageHit
+}
+
+func (s *lockedStore) getOrCreate(name string) *PageHit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pg, exists := s.pages[name]; exists {
+		return pg
+	}
+	pg := newPageHit(name)
+	s.pages[name] = pg
+	return pg
+}
+
+// run hit in parallel over 10000 pages, each goroutine starting at its own page
+func benchmarkIngest(b *testing.B, hit func(name string)) {
+	pages := make([]string, 10000)
+	for i := range pages {
+		pages[i] = fmt.Sprintf("/page/%d", i)
+	}
+	var workers atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(workers.Add(1)) * 7919
+		for pb.Next() {
+			hit(pages[i%len(pages)])
+			i++
+		}
+	})
+}
+
+// go test -bench Ingest -cpu 1,2,4,8 hit_counter_server.go hit_counter_server_test.go
+func BenchmarkIngestLocked(b *testing.B) {
+	store := &lockedStore{pages: make(map[string]*PageHit)}
+	benchmarkIngest(b, func(name string) {
+		store.getOrCreate(name).hit.Add(1)
+	})
+}
+
+func BenchmarkIngestSharded(b *testing.B) {
+	store := newPageStore()
+	benchmarkIngest(b, func(name string) {
+		store.getOrCreate(store.hash(name), name).hit.Add(1)
+	})
+}
+
+// the full hit path: windows, unique sketches and heavy hitters
+func BenchmarkIngestFull(b *testing.B) {
+	hcs := NewHitCounterServer(Config{})
+	benchmarkIngest(b, func(name string) {
+		hcs.recordHit(hitRequest{Page: name, Visitor: "bench"})
+	})
+}
+
+// gossip about evicted pages is merged into their files, the pages stay on disk
+func TestGossipMergesEvictedPages(t *testing.T) {
+	cfg := testConfig()
+	cfg.NodeID = "a"
+	hcs := NewHitCounterServer(cfg)
+	spill, err := openSpillStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcs.pages.spill = spill
+
+	for _, name := range []string{"/one", "/two"} {
+		hcs.recordHit(hitRequest{Page: name, Visitor: "v1"})
+		page, _ := hcs.pages.peek(name)
+		if !hcs.pages.evict(page) {
+			t.Fatalf("%s not evicted", name)
+		}
+	}
+
+	// a round with nothing new, then one where the peer has more hits on /two
+	msg := hcs.gossipState()
+	if len(msg.Pages) != 2 || msg.Pages["/one"].Counts["a"] != 1 {
+		t.Fatalf("gossip state %+v, want both evicted pages", msg.Pages)
+	}
+	hcs.mergeGossip(gossipMessage{Node: "b", Pages: msg.Pages})
+	hcs.mergeGossip(gossipMessage{Node: "b", Pages: map[string]gossipPage{"/two": {Counts: map[string]uint64{"b": 5}}}})
+
+	if n := hcs.pages.len(); n != 0 {
+		t.Errorf("%d pages in memory, want 0", n)
+	}
+	if n := hcs.pages.reloads.Load(); n != 0 {
+		t.Errorf("%d reloads, want 0", n)
+	}
+	rows, _, _ := hcs.queryStats(listQuery{Sort: "name"})
+	if len(rows) != 2 || rows[1].Page != "/two" || rows[1].Hits != 6 || rows[1].LastMinute != 1 || rows[1].Uniques != 1 {
+		t.Errorf("stats %+v, want /two with 6 hits, 1 in the last minute and 1 unique", rows)
+	}
+
+	// the state file copies the files of the evicted pages
+	path := t.TempDir() + "/state.json"
+	if n, err := hcs.saveState(path); err != nil || n != 2 {
+		t.Fatalf("saveState: %d %v", n, err)
+	}
+	restarted := NewHitCounterServer(cfg)
+	if n, err := restarted.loadState(path); err != nil || n != 2 {
+		t.Fatalf("loadState: %d %v", n, err)
+	}
+	if page, _ := restarted.lookupPage("/two"); page == nil || page.total() != 6 {
+		t.Errorf("restored /two %v, want 6 hits", page)
+	}
+
+	// the merged file is what comes back on the next hit
+	page, _, _ := hcs.recordHit(hitRequest{Page: "/two", Visitor: "v2"})
+	if page.total() != 7 {
+		t.Errorf("/two total %d after reload, want 7", page.total())
+	}
+}
+
+// a merge import adds to our entry and keeps the epoch, replace starts a new one
+func TestImportMergeKeepsEpoch(t *testing.T) {
+	cfg := testConfig()
+	cfg.NodeID = "a"
+	hcs := NewHitCounterServer(cfg)
+	hcs.recordHit(hitRequest{Page: "/home", Visitor: "v1"})
+	hcs.mergeGossip(gossipMessage{Node: "b", Pages: map[string]gossipPage{"/home": {Counts: map[string]uint64{"b": 4}}}})
+
+	hcs.importPages([]importRow{{Page: "/home", Hits: 10}}, "merge")
+	page, _ := hcs.lookupPage("/home")
+	epoch, counts := page.counters("a")
+	if epoch != 0 || counts["a"] != 11 || counts["b"] != 4 {
+		t.Errorf("after merge: epoch %d counts %v, want epoch 0, a 11 and b 4", epoch, counts)
+	}
+	if n, _ := page.windowHits(time.Minute); n != 1 {
+		t.Errorf("after merge: %d hits in the last minute, want 1", n)
+	}
+
+	hcs.importPages([]importRow{{Page: "/home", Hits: 3}}, "replace")
+	epoch, counts = page.counters("a")
+	if epoch != 1 || page.total() != 3 || counts["b"] != 0 {
+		t.Errorf("after replace: epoch %d counts %v, want epoch 1 and a total of 3", epoch, counts)
+	}
+}
+
+// connection that keeps what the server writes to it
+type recordConn struct {
+	net.Conn
+	out strings.Builder
+}
+
+func (c *recordConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+
+func (c *recordConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+}
+
+// a total lowered by an admin is a reset, not a huge delta
+func TestWatchReset(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	for i := 0; i < 3; i++ {
+		hcs.recordHit(hitRequest{Page: "/a", Visitor: fmt.Sprint(i)})
+	}
+	rec := &recordConn{}
+	w := &watcher{target: "/a", conn: &clientConn{Conn: rec}, last: make(map[string]uint64)}
+
+	hcs.pushDeltas(w, true)
+	hcs.recordHit(hitRequest{Page: "/a", Visitor: "v"})
+	hcs.pushDeltas(w, false)
+	if err := hcs.runAdmin([]string{"SET", "/a", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	hcs.pushDeltas(w, false)
+
+	want := "Watch /a Hit 3 (+0)\nWatch /a Hit 4 (+1)\nWatch /a Hit 2 (reset)\n"
+	if got := rec.out.String(); got != want {
+		t.Errorf("pushed %q, want %q", got, want)
+	}
+}
+
+// WATCH targets are canonicalized like the pages they are compared with
+func TestWatchCanonicalTarget(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	conn := &clientConn{Conn: &recordConn{}, watchers: make(map[string]*watcher)}
+	defer hcs.unwatchAll(conn)
+
+	tests := []struct {
+		target string
+		page   string
+		match  bool
+	}{
+		{"/Blog/Post", "/blog/post", true},
+		{"/Blog/Post/", "/blog/post", true},
+		{"/Blog/*", "/blog/post", true},
+		{"/Blog%2FP*", "/blog/post", true},
+		{"/Blog/*", "/blogroll", false},
+		{"/home?utm_source=x", "/home", true},
+	}
+	for _, tt := range tests {
+		hcs.watch(conn, []string{tt.target, "1h"})
+		w := conn.watchers[tt.target]
+		if w == nil {
+			t.Fatalf("WATCH %s not registered", tt.target)
+		}
+		if got := w.matches(tt.page); got != tt.match {
+			t.Errorf("WATCH %s matches %s: %v, want %v", tt.target, tt.page, got, tt.match)
+		}
+	}
+}
+
+// the rollup counts hits, not admin changes, and forgets deleted pages
+func TestRollupHistory(t *testing.T) {
+	cfg := testConfig()
+	cfg.HistoryDir = t.TempDir()
+	hcs := NewHitCounterServer(cfg)
+	hit := func(page string, n int) {
+		for i := 0; i < n; i++ {
+			hcs.recordHit(hitRequest{Page: page, Visitor: fmt.Sprint(i)})
+		}
+	}
+	admin := func(args ...string) {
+		if err := hcs.runAdmin(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	minute := func(i int) time.Time { return start.Add(time.Duration(i) * time.Minute) }
+
+	hit("/a", 5)
+	hit("/b", 1)
+	hcs.rollup(minute(0)) // baseline
+	hit("/a", 3)
+	hcs.rollup(minute(1))
+	admin("SET", "/a", "100")
+	hcs.rollup(minute(2))
+	hit("/a", 2)
+	admin("DELETE", "/b")
+	hcs.rollup(minute(3))
+
+	got := make(map[time.Time]uint64)
+	hcs.history.scan(hcs.history.resolutions[0], start, minute(4), "/a", func(at time.Time, _ string, n uint64) {
+		got[at.UTC()] = n
+	})
+	want := map[time.Time]uint64{minute(0): 3, minute(2): 2}
+	if len(got) != len(want) || got[minute(0)] != 3 || got[minute(2)] != 2 {
+		t.Errorf("history of /a %v, want %v", got, want)
+	}
+	if _, ok := hcs.history.last["/b"]; ok {
+		t.Error("deleted /b is still in the rollup totals")
+	}
+}
+
+// SCAN returns every page once, in steps of COUNT, even while pages come and go
+func TestRESPScan(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	for i := 0; i < 500; i++ {
+		hcs.recordHit(hitRequest{Page: fmt.Sprintf("/p%d", i), Visitor: "v"})
+	}
+
+	seen := make(map[string]int)
+	cursor, calls := "0", 0
+	for {
+		var out strings.Builder
+		hcs.respScan(&out, []string{cursor, "COUNT", "20"})
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\r\n"), "\r\n")
+		cursor = lines[2]
+		for i := 5; i < len(lines); i += 2 {
+			seen[lines[i]]++
+		}
+		calls++
+		// pages created and deleted during the scan don't make others skip or repeat
+		hcs.recordHit(hitRequest{Page: fmt.Sprintf("/new%d", calls), Visitor: "v"})
+		hcs.runAdmin([]string{"DELETE", fmt.Sprintf("/new%d", calls-1)})
+		if cursor == "0" || calls > 1000 {
+			break
+		}
+	}
+	for i := 0; i < 500; i++ {
+		if n := seen[fmt.Sprintf("/p%d", i)]; n != 1 {
+			t.Fatalf("/p%d returned %d times", i, n)
+		}
+	}
+	if calls < 500/20 {
+		t.Errorf("scan done in %d calls of COUNT 20", calls)
+	}
+
+	var out strings.Builder
+	hcs.respCommand(&out, "127.0.0.1", []string{"DBSIZE"})
+	if want := fmt.Sprintf(":%d\r\n", hcs.pages.count()); out.String() != want || hcs.pages.count() != 501 {
+		t.Errorf("DBSIZE %q, want 501 pages", out.String())
+	}
+}
+
+// a huge array length alone doesn't allocate, the arguments must arrive
+func TestReadRESPCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		args []string
+		ok   bool
+	}{
+		{"*2\r\n$3\r\nGET\r\n$5\r\n/home\r\n", []string{"GET", "/home"}, true},
+		{"PING hello\r\n", []string{"PING", "hello"}, true},
+		{"*1048576\r\n$4\r\nPING\r\n", nil, false},
+		{"*2\r\n:1\r\n", nil, false},
+		{"*-1\r\n", nil, false},
+		{"*1\r\n$2000000\r\n", nil, false},
+		{"*1\r\n$5\r\n/ho", nil, false},
+		{"*0\r\n", nil, true},
+		{"*1\r\n$0\r\n\r\n", []string{""}, true},
+		{"*1\r\n$x\r\n", nil, false},
+		{"  INCRBY   /home 3\n", []string{"INCRBY", "/home", "3"}, true},
+	}
+	for _, tt := range tests {
+		args, err := readRESPCommand(bufio.NewReader(strings.NewReader(tt.in)))
+		if (err == nil) != tt.ok || strings.Join(args, " ") != strings.Join(tt.args, " ") {
+			t.Errorf("%q: %q %v", tt.in, args, err)
+		}
+	}
+}
+
+// a sparse sketch estimates like its dense registers and turns dense once full
+func TestHyperLogLogSparse(t *testing.T) {
+	for _, n := range []int{0, 1, 10, hllSparseMax / 2, 1000, 100000} {
+		h := &hyperLogLog{}
+		for i := 0; i < n; i++ {
+			h.add(hashVisitor(fmt.Sprint("visitor-", i)))
+		}
+		dense := &hyperLogLog{registers: h.dense()}
+		if got, want := h.estimate(), dense.estimate(); got != want {
+			t.Errorf("%d visitors: sparse estimate %d, dense %d", n, got, want)
+		}
+		loaded, err := loadHyperLogLog(h.dense())
+		if err != nil || loaded.estimate() != h.estimate() {
+			t.Errorf("%d visitors: loaded sketch %v %v", n, loaded, err)
+		}
+		if sparse := h.registers == nil; sparse != (n <= hllSparseMax/2) {
+			t.Errorf("%d visitors: sparse %v with %d entries", n, sparse, len(h.sparse))
+		}
+		if n <= 10 && h.size() >= 1<<hllPrecision/4 {
+			t.Errorf("%d visitors take %d bytes", n, h.size())
+		}
+	}
+}
+
+// windows are answered by the finest ring that covers them, rounded up to whole buckets
+func TestHitWindows(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 30, 30, 0, time.UTC)
+	// oldest first, like hits arrive. the hit of 25h ago shares its hour bucket
+	// with the one of 59m ago, which starts the bucket again
+	hits := []time.Duration{25 * time.Hour, 23 * time.Hour, 3 * time.Hour, 59 * time.Minute, 2 * time.Minute, 59 * time.Second, 5 * time.Second, 0}
+	w := newHitWindows()
+	for _, ago := range hits {
+		w.add(now.Add(-ago), 1)
+	}
+	tests := []struct {
+		window time.Duration
+		want   uint64
+	}{
+		{time.Second, 1},
+		{10 * time.Second, 2},
+		{time.Minute, 3},
+		{90 * time.Second, 3}, // two minute buckets, 12:29 and 12:30
+		{5 * time.Minute, 4},
+		{time.Hour, 5},
+		{4 * time.Hour, 6},
+		{24 * time.Hour, 7},
+	}
+	for _, tt := range tests {
+		got, err := w.sum(now, tt.window)
+		if err != nil || got != tt.want {
+			t.Errorf("window %s: %d %v, want %d", tt.window, got, err, tt.want)
+		}
+	}
+	if _, err := w.sum(now, 25*time.Hour); err == nil {
+		t.Error("a window longer than a day is accepted")
+	}
+
+	// a ring slot reused by a newer time starts again instead of adding up
+	later := now.Add(time.Minute)
+	w.add(later, 1)
+	if got, _ := w.sum(later, time.Second); got != 1 {
+		t.Errorf("reused second bucket holds %d hits", got)
+	}
+
+	other := newHitWindows()
+	other.add(later, 2)
+	w.merge(other)
+	if got, _ := w.sum(later, time.Second); got != 3 {
+		t.Errorf("merged second bucket holds %d hits, want 3", got)
+	}
+}
+
+// estimates stay within 10% (about 3 standard errors) and repeated visitors don't count twice
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{1, 10, 100, 1000, 10000, 100000} {
+		h := &hyperLogLog{}
+		for i := 0; i < n; i++ {
+			hash := hashVisitor(fmt.Sprint("visitor-", i))
+			h.add(hash)
+			h.add(hash)
+		}
+		got := float64(h.estimate())
+		if got < float64(n)*0.9 || got > float64(n)*1.1 {
+			t.Errorf("%d visitors estimated as %.0f", n, got)
+		}
+	}
+}
+
+// hourly sketches answer windows and merge as a union of the visitors
+func TestUniqueSketches(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 30, 0, 0, time.UTC)
+	var u uniqueSketches
+	u.add(now.Add(-3*time.Hour), "a")
+	u.add(now.Add(-30*time.Minute), "b")
+	u.add(now, "b")
+	u.add(now, "c")
+	tests := []struct {
+		window time.Duration
+		want   uint64
+	}{
+		{time.Minute, 2}, // the current hour
+		{time.Hour, 2},
+		{2 * time.Hour, 2}, // b 30m ago is 12:00, the same hour
+		{4 * time.Hour, 3},
+		{24 * time.Hour, 3},
+	}
+	for _, tt := range tests {
+		if got, err := u.window(now, tt.window); err != nil || got != tt.want {
+			t.Errorf("window %s: %d %v, want %d", tt.window, got, err, tt.want)
+		}
+	}
+	if got := u.total(); got != 3 {
+		t.Errorf("lifetime %d, want 3", got)
+	}
+
+	var other uniqueSketches
+	other.add(now, "c")
+	other.add(now, "d")
+	u.merge(&other)
+	if got, _ := u.window(now, time.Hour); got != 3 {
+		t.Errorf("merged hour %d, want 3", got)
+	}
+	if got := u.total(); got != 4 {
+		t.Errorf("merged lifetime %d, want 4", got)
+	}
+}
+
+// Space-Saving keeps the heavy hitters, over estimates by at most err and never under counts
+func TestSpaceSaving(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []string
+		keep   []string
+	}{
+		{"fits", []string{"a", "b", "a", "c"}, []string{"a", "b", "c"}},
+		{"evicts the smallest", []string{"a", "a", "b", "b", "c", "d"}, []string{"a", "b", "d"}},
+		{"heavy hitter after noise", []string{"x", "y", "z", "w", "h", "h", "h", "h", "h"}, []string{"h"}},
+	}
+	for _, tt := range tests {
+		s := newSpaceSaving(3)
+		exact := make(map[string]uint64)
+		for _, key := range tt.stream {
+			s.add(key, 1)
+			exact[key]++
+		}
+		if len(s.entries) > 3 {
+			t.Errorf("%s: %d entries over capacity", tt.name, len(s.entries))
+		}
+		for _, key := range tt.keep {
+			if _, ok := s.entries[key]; !ok {
+				t.Errorf("%s: %s was dropped", tt.name, key)
+			}
+		}
+		for key, e := range s.entries {
+			if e.count < exact[key] || e.count-e.err > exact[key] {
+				t.Errorf("%s: %s counted %d err %d, real %d", tt.name, key, e.count, e.err, exact[key])
+			}
+		}
+	}
+}
+
+// windowed TOP ranks the pages of the window across every stripe
+func TestTopStripes(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 30, 0, 0, time.UTC)
+	top := newTopStripes()
+	add := func(at time.Time, page string, n uint64) {
+		top.add(at, hashVisitor(page), page, n)
+	}
+	add(now.Add(-2*time.Hour), "/old", 100)
+	add(now.Add(-10*time.Minute), "/a", 5)
+	add(now, "/a", 5)
+	add(now, "/b", 7)
+	add(now, "/c", 1)
+
+	tests := []struct {
+		window time.Duration
+		k      int
+		want   string
+	}{
+		{time.Minute, 3, "[{/b 7} {/a 5} {/c 1}]"},
+		{time.Hour, 2, "[{/a 10} {/b 7}]"},
+		{3 * time.Hour, 1, "[{/old 100}]"},
+	}
+	for _, tt := range tests {
+		got, err := top.top(now, tt.window, tt.k)
+		if err != nil || fmt.Sprint(got) != tt.want {
+			t.Errorf("top %d of %s: %v %v, want %s", tt.k, tt.window, got, err, tt.want)
+		}
+	}
+	if _, err := top.top(now, 48*time.Hour, 1); err == nil {
+		t.Error("a window longer than a day is accepted")
+	}
+}
+
+func TestParseListQuery(t *testing.T) {
+	tests := []struct {
+		args []string
+		want listQuery
+		err  bool
+	}{
+		{nil, listQuery{Sort: "name", Format: "text"}, false},
+		{[]string{"prefix", "/blog", "SORT", "HITS", "limit", "2", "FORMAT", "json"}, listQuery{Prefix: "/blog", Sort: "hits", Limit: 2, Format: "json"}, false},
+		{[]string{"OFFSET", "3"}, listQuery{Sort: "name", Offset: 3, Format: "text"}, false},
+		{[]string{"LIMIT"}, listQuery{}, true},
+		{[]string{"LIMIT", "-1"}, listQuery{}, true},
+		{[]string{"SORT", "uniques"}, listQuery{}, true},
+		{[]string{"FORMAT", "xml"}, listQuery{}, true},
+		{[]string{"COLOR", "red"}, listQuery{}, true},
+		{[]string{"OFFSET", "1", "CURSOR", "x"}, listQuery{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseListQuery(tt.args)
+		if (err != nil) != tt.err || (err == nil && got != tt.want) {
+			t.Errorf("%v: %+v %v, want %+v (error %v)", tt.args, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// listings filter by prefix, sort, and page with offsets or cursors that don't repeat rows
+func TestQueryStats(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	for page, n := range map[string]uint64{"/a": 3, "/blog/x": 5, "/blog/y": 5, "/blog/z": 1} {
+		hcs.recordHit(hitRequest{Page: page, Count: n, Aggregate: true})
+	}
+	names := func(rows []pageStatsJSON) string {
+		var out []string
+		for _, r := range rows {
+			out = append(out, fmt.Sprintf("%s=%d", r.Page, r.Hits))
+		}
+		return strings.Join(out, " ")
+	}
+
+	tests := []struct {
+		query listQuery
+		want  string
+		more  bool
+	}{
+		{listQuery{Sort: "name"}, "/a=3 /blog/x=5 /blog/y=5 /blog/z=1", false},
+		{listQuery{Sort: "hits"}, "/blog/x=5 /blog/y=5 /a=3 /blog/z=1", false},
+		{listQuery{Sort: "hits", Prefix: "/blog/"}, "/blog/x=5 /blog/y=5 /blog/z=1", false},
+		{listQuery{Sort: "name", Limit: 2}, "/a=3 /blog/x=5", true},
+		{listQuery{Sort: "name", Offset: 3}, "/blog/z=1", false},
+		{listQuery{Sort: "name", Offset: 10}, "", false},
+	}
+	for _, tt := range tests {
+		rows, next, err := hcs.queryStats(tt.query)
+		if err != nil || names(rows) != tt.want || (next != "") != tt.more {
+			t.Errorf("%+v: %q next %q %v, want %q", tt.query, names(rows), next, err, tt.want)
+		}
+	}
+
+	// walk the hits order two rows at a time. a page created in between shows up
+	// in its place after the cursor, without repeating or skipping a row
+	var got []string
+	q := listQuery{Sort: "hits", Limit: 2}
+	for i := 0; i < 5; i++ {
+		rows, next, err := hcs.queryStats(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, names(rows))
+		if i == 0 {
+			hcs.recordHit(hitRequest{Page: "/0"})
+		}
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	if want := "/blog/x=5 /blog/y=5|/a=3 /0=1|/blog/z=1"; strings.Join(got, "|") != want {
+		t.Errorf("cursor pages %q, want %q", strings.Join(got, "|"), want)
+	}
+	if _, _, err := hcs.queryStats(listQuery{Sort: "name", Cursor: q.Cursor}); err == nil {
+		t.Error("a cursor of the hits order is accepted for the name order")
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	long := strings.Repeat("k", maxTagKeyLength+5)
+	tests := []struct {
+		tokens []string
+		want   string
+		err    bool
+	}{
+		{nil, "map[]", false},
+		{[]string{"Ref=google.com", "country=ET"}, "map[country:ET ref:google.com]", false},
+		{[]string{"a=b=c"}, "map[a:b=c]", false},
+		{[]string{long + "=v"}, fmt.Sprintf("map[%s:v]", long[:maxTagKeyLength]), false},
+		{[]string{"ref"}, "", true},
+		{[]string{"=x"}, "", true},
+		{[]string{"ref="}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseTags(tt.tokens)
+		if (err != nil) != tt.err || (err == nil && fmt.Sprint(got) != tt.want) {
+			t.Errorf("%v: %v %v, want %s (error %v)", tt.tokens, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// extra values go to (other) and extra keys to (dropped), so the counts never grow unbounded
+func TestTagLimits(t *testing.T) {
+	var tags tagCounts
+	for i := 0; i < maxValuesPerDim+10; i++ {
+		tags.add(map[string]string{"ref": fmt.Sprint("site", i)}, 1)
+	}
+	for i := 1; i < maxDimensions+2; i++ {
+		tags.add(map[string]string{fmt.Sprint("key", i): "v"}, 2)
+	}
+	tags.add(map[string]string{"ref": "site0"}, 5)
+
+	refs, ok := tags.breakdown("ref")
+	if !ok || len(refs) != maxValuesPerDim+1 {
+		t.Fatalf("ref has %d values, want %d", len(refs), maxValuesPerDim+1)
+	}
+	if refs[0] != (rankedPage{Name: otherTagValue, Hits: 10}) || refs[1] != (rankedPage{Name: "site0", Hits: 6}) {
+		t.Errorf("ref breakdown starts with %v", refs[:2])
+	}
+	dropped, _ := tags.breakdown(droppedDimensionKey)
+	if len(tags.dims) != maxDimensions+1 || len(dropped) != 2 {
+		t.Errorf("%d dimensions, dropped keys %v", len(tags.dims), dropped)
+	}
+	if _, ok := tags.breakdown("country"); ok {
+		t.Error("an unknown dimension is found")
+	}
+
+	// a merge that meets the overflow counts first keeps every real key and value
+	var merged tagCounts
+	merged.add(map[string]string{"ref": otherTagValue, droppedDimensionKey: "key0"}, 10)
+	merged.merge(&tags)
+	if got, _ := merged.breakdown("ref"); len(got) != maxValuesPerDim+1 || got[0].Hits != 20 || got[1].Hits != 6 {
+		t.Errorf("merged ref has %d values starting with %v", len(got), got[:2])
+	}
+	if got, _ := merged.breakdown(droppedDimensionKey); len(merged.dims) != maxDimensions+1 || len(got) != 3 {
+		t.Errorf("merged %d dimensions, dropped keys %v", len(merged.dims), got)
+	}
+}
+
+// entries merge by max, our own entry included, and the epoch decides which state wins
+func TestMergeCounters(t *testing.T) {
+	page := newPageHit("/a")
+	page.record(5, "v", nil)
+	steps := []struct {
+		epoch    uint64
+		counters map[string]uint64
+		want     string // epoch and entries after the merge
+		total    uint64
+	}{
+		{0, map[string]uint64{"a": 3, "b": 4}, "0 map[a:5 b:4]", 9},
+		{0, map[string]uint64{"b": 2, "c": 1}, "0 map[a:5 b:4 c:1]", 10},
+		{0, map[string]uint64{"a": 8}, "0 map[a:8 b:4 c:1]", 13}, // our count after a restart
+		{0, map[string]uint64{"b": 4, "c": 1}, "0 map[a:8 b:4 c:1]", 13},
+		{1, map[string]uint64{"b": 2}, "1 map[a:0 b:2]", 2}, // an admin change on b
+		{0, map[string]uint64{"c": 50}, "1 map[a:0 b:2]", 2},
+		{1, map[string]uint64{"a": 1, "b": 2}, "1 map[a:1 b:2]", 3},
+	}
+	for i, step := range steps {
+		page.mergeCounters("a", step.epoch, step.counters)
+		epoch, counts := page.counters("a")
+		if got := fmt.Sprint(epoch, " ", counts); got != step.want || page.total() != step.total {
+			t.Errorf("step %d: %s total %d, want %s total %d", i, got, page.total(), step.want, step.total)
+		}
+	}
+	if n, _ := page.windowHits(time.Minute); n != 0 {
+		t.Errorf("the windows kept %d hits of the old epoch", n)
+	}
+}
+
+// nodes converge whatever the order of the exchanges, and a deleted page only
+// comes back with a change made after the delete
+func TestGossipConvergence(t *testing.T) {
+	nodes := make(map[string]*HitCounterServer)
+	for i, id := range []string{"a", "b", "c"} {
+		cfg := testConfig()
+		cfg.NodeID = id
+		nodes[id] = NewHitCounterServer(cfg)
+		nodes[id].recordHit(hitRequest{Page: "/x", Count: uint64(i + 1), Aggregate: true})
+		nodes[id].recordHit(hitRequest{Page: "/y", Count: 10, Aggregate: true})
+	}
+	exchange := func(from, to string) { nodes[to].mergeGossip(nodes[from].gossipState()) }
+	total := func(id, name string) uint64 {
+		page, ok := nodes[id].lookupPage(name)
+		if !ok {
+			return 0
+		}
+		return page.total()
+	}
+
+	for _, pair := range [][2]string{{"a", "b"}, {"c", "b"}, {"b", "a"}, {"b", "c"}, {"a", "b"}} {
+		exchange(pair[0], pair[1])
+	}
+	for id := range nodes {
+		if total(id, "/x") != 6 || total(id, "/y") != 30 {
+			t.Errorf("node %s: /x %d /y %d, want 6 and 30", id, total(id, "/x"), total(id, "/y"))
+		}
+	}
+
+	if err := nodes["a"].runAdmin([]string{"DELETE", "/x"}); err != nil {
+		t.Fatal(err)
+	}
+	nodes["c"].recordHit(hitRequest{Page: "/x", Count: 4, Aggregate: true})
+	exchange("a", "b")
+	exchange("c", "b") // c still has the old /x with more hits
+	if _, ok := nodes["b"].lookupPage("/x"); ok {
+		t.Error("an older epoch brought the deleted page back")
+	}
+	exchange("b", "c")
+	if _, ok := nodes["c"].lookupPage("/x"); ok {
+		t.Error("the tombstone didn't delete the page on c")
+	}
+
+	nodes["c"].recordHit(hitRequest{Page: "/x", Count: 2, Aggregate: true})
+	exchange("c", "a")
+	exchange("c", "b")
+	for id := range nodes {
+		if total(id, "/x") != 2 {
+			t.Errorf("node %s: recreated /x %d, want 2", id, total(id, "/x"))
+		}
+	}
+}
+
+// a prefix watcher pushes the pages that changed, new pages included, and nothing else
+func TestWatchPrefixDeltas(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	hcs.recordHit(hitRequest{Page: "/blog/a", Count: 2, Aggregate: true})
+	hcs.recordHit(hitRequest{Page: "/blog/b", Aggregate: true})
+	hcs.recordHit(hitRequest{Page: "/home", Aggregate: true})
+	rec := &recordConn{}
+	w := &watcher{target: "/blog/", prefix: true, conn: &clientConn{Conn: rec}, last: make(map[string]uint64)}
+
+	steps := []struct {
+		hits []string
+		want []string
+	}{
+		{nil, []string{"Watch /blog/a Hit 2 (+0)", "Watch /blog/b Hit 1 (+0)"}},
+		{[]string{"/blog/a", "/blog/a", "/home"}, []string{"Watch /blog/a Hit 4 (+2)"}},
+		{[]string{"/blog/c", "/blogroll"}, []string{"Watch /blog/c Hit 1 (+1)"}},
+		{nil, nil},
+	}
+	for i, step := range steps {
+		for _, page := range step.hits {
+			hcs.recordHit(hitRequest{Page: page, Aggregate: true})
+		}
+		rec.out.Reset()
+		if err := hcs.pushDeltas(w, i == 0); err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Split(strings.TrimSuffix(rec.out.String(), "\n"), "\n")
+		sort.Strings(got)
+		if strings.Join(got, "|") != strings.Join(step.want, "|") {
+			t.Errorf("step %d pushed %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+// bad arguments are refused without registering a watcher
+func TestWatchUsage(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "Usage: WATCH"},
+		{[]string{"/a", "1s", "x"}, "Usage: WATCH"},
+		{[]string{"/a", "soon"}, "Invalid interval soon"},
+		{[]string{"/a", "1ms"}, "Invalid interval 1ms"},
+	}
+	for _, tt := range tests {
+		rec := &recordConn{}
+		conn := &clientConn{Conn: rec, watchers: make(map[string]*watcher)}
+		hcs.watch(conn, tt.args)
+		if !strings.HasPrefix(rec.out.String(), tt.want) || len(conn.watchers) != 0 {
+			t.Errorf("WATCH %v: %q with %d watchers", tt.args, rec.out.String(), len(conn.watchers))
+		}
+	}
+	if n := hcs.pushWatchers.Load(); n != 0 {
+		t.Errorf("%d push watchers registered", n)
+	}
+}
+
+// the filters run in order and each drop is counted under its reason
+func TestHitFilter(t *testing.T) {
+	cfg := testConfig()
+	cfg.DenyUA = []string{" Bot ", "", "crawler"}
+	cfg.IPRate = 1
+	cfg.VisitorRate = 1
+	cfg.RateBurst = 2
+	cfg.DedupWindow = time.Minute
+	f := newHitFilter(cfg)
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		at  time.Duration
+		req hitRequest
+		err error
+	}{
+		{0, hitRequest{Page: "/a", Visitor: "v1", Remote: "ip1", UA: "Googlebot/2.1"}, errBotHit},
+		{0, hitRequest{Page: "/a", Visitor: "v1", Remote: "ip1", UA: "Firefox"}, nil},
+		{0, hitRequest{Page: "/a", Visitor: "v1", Remote: "ip2"}, errDuplicate},
+		{0, hitRequest{Page: "/b", Visitor: "v1", Remote: "ip3"}, errRateLimit}, // the duplicate took v1's last token
+		{0, hitRequest{Page: "/d", Visitor: "v2", Remote: "ip1"}, nil},
+		{0, hitRequest{Page: "/e", Visitor: "v3", Remote: "ip1"}, errRateLimit}, // ip1 used its burst
+		{0, hitRequest{Page: "/e", Visitor: "v3", Remote: "ip1", Count: 5, Aggregate: true}, errRateLimit},
+		{time.Second, hitRequest{Page: "/e", Visitor: "v3", Remote: "ip1"}, nil},
+		{2 * time.Second, hitRequest{Page: "/e", Visitor: "host", Remote: "ip5", Aggregate: true}, nil},
+		{2 * time.Second, hitRequest{Page: "/e", Visitor: "host", Remote: "ip5", Aggregate: true}, nil},
+		{30 * time.Second, hitRequest{Page: "/a", Visitor: "v1", Remote: "ip6"}, errDuplicate},
+		{61 * time.Second, hitRequest{Page: "/a", Visitor: "v1", Remote: "ip6"}, nil},
+	}
+	for i, step := range steps {
+		if err := f.check(step.req, start.Add(step.at)); err != step.err {
+			t.Errorf("step %d: %v, want %v", i, err, step.err)
+		}
+	}
+	if f.stats.bots.Load() != 1 || f.stats.rateLimits.Load() != 3 || f.stats.duplicates.Load() != 2 {
+		t.Errorf("dropped %d bots, %d rate limited, %d duplicates", f.stats.bots.Load(), f.stats.rateLimits.Load(), f.stats.duplicates.Load())
+	}
+
+	// the sweep forgets the senders whose bucket refilled and the old duplicates
+	later := start.Add(time.Hour)
+	f.ipLimit.sweep(later)
+	f.dedup.sweep(later)
+	if len(f.ipLimit.buckets) != 0 || len(f.dedup.seen) != 0 {
+		t.Errorf("after the sweep: %d buckets, %d duplicates", len(f.ipLimit.buckets), len(f.dedup.seen))
+	}
+}
+
+// admin commands need AUTH, work on canonical pages and every attempt is audited
+func TestAdminCommands(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminToken = "secret"
+	hcs := NewHitCounterServer(cfg)
+	logPath := t.TempDir() + "/audit.log"
+	audit, err := openAuditLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	hcs.audit = audit
+	hcs.recordHit(hitRequest{Page: "/home", Count: 3, Aggregate: true})
+	hcs.recordHit(hitRequest{Page: "/old", Count: 2, Aggregate: true})
+
+	rec := &recordConn{}
+	conn := &clientConn{Conn: rec}
+	hcs.adminCommand(conn, []string{"SET", "/home", "1"})
+	hcs.authenticate(conn, "wrong")
+	hcs.authenticate(conn, "secret")
+
+	tests := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"SET", "/Home/", "10"}, "SET /Home/ 10 done"},
+		{[]string{"SET", "/home", "x"}, "SET failed: invalid count x"},
+		{[]string{"SET", "#", "1"}, "SET failed: invalid page #"},
+		{[]string{"RENAME", "/old", "/HOME"}, "RENAME /old /HOME done"},
+		{[]string{"RENAME", "/home", "/home/"}, "RENAME failed: old and new are the same page"},
+		{[]string{"RESET", "/missing"}, "RESET failed: unknown page /missing"},
+		{[]string{"DELETE"}, "DELETE failed: usage: DELETE <page>"},
+		{[]string{"DELETE", "/home"}, "DELETE /home done"},
+		{[]string{"DELETE", "/home"}, "DELETE failed: unknown page /home"},
+	}
+	want := []string{"Admin command SET needs AUTH first", "Invalid token", "Authenticated"}
+	for i, tt := range tests {
+		hcs.adminCommand(conn, tt.args)
+		want = append(want, tt.reply)
+		if i == 3 {
+			// the renamed hits land on the canonical page, in a new epoch
+			page, _ := hcs.lookupPage("/home")
+			if epoch, _ := page.counters(""); page.total() != 12 || epoch != 2 {
+				t.Errorf("after RENAME: /home total %d epoch %d, want 12 and 2", page.total(), epoch)
+			}
+		}
+	}
+	if got := strings.Split(strings.TrimSuffix(rec.out.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("replies\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2+len(tests) {
+		t.Fatalf("%d audit entries, want %d", len(lines), 2+len(tests))
+	}
+	for i, want := range map[int]string{0: `"action":"AUTH","result":"denied"`, 1: `"action":"AUTH","result":"ok"`, 3: `"args":["/home","x"],"result":"invalid count x"`} {
+		if !strings.Contains(lines[i], want) || !strings.Contains(lines[i], `"remote":"127.0.0.1:4000"`) {
+			t.Errorf("audit entry %d: %s, want %s", i, lines[i], want)
+		}
+	}
+}
+
+func TestRESPCommands(t *testing.T) {
+	hcs := NewHitCounterServer(testConfig())
+	hcs.recordHit(hitRequest{Page: "/home", Count: 2, Aggregate: true})
+	tests := []struct {
+		args  []string
+		reply string
+		more  bool
+	}{
+		{[]string{"ping"}, "+PONG\r\n", true},
+		{[]string{"PING", "hi"}, "$2\r\nhi\r\n", true},
+		{[]string{"ECHO"}, "-ERR wrong number of arguments for 'echo' command\r\n", true},
+		{[]string{"INCR", "/Home/"}, ":3\r\n", true},
+		{[]string{"INCRBY", "/home", "10"}, ":13\r\n", true},
+		{[]string{"INCRBY", "/home", "0"}, "-ERR value is not a positive integer or out of range\r\n", true},
+		{[]string{"INCRBY", "/home", "-1"}, "-ERR value is not a positive integer or out of range\r\n", true},
+		{[]string{"INCR"}, "-ERR wrong number of arguments for 'incr' command\r\n", true},
+		{[]string{"GET", "/HOME"}, "$2\r\n13\r\n", true},
+		{[]string{"GET", "/missing"}, "$-1\r\n", true},
+		{[]string{"MGET", "/home", "/missing"}, "*2\r\n$2\r\n13\r\n$-1\r\n", true},
+		{[]string{"EXISTS", "/home", "/missing", "/home"}, ":2\r\n", true},
+		{[]string{"DBSIZE"}, ":1\r\n", true},
+		{[]string{"SCAN"}, "-ERR wrong number of arguments for 'scan' command\r\n", true},
+		{[]string{"SCAN", "0", "COUNT"}, "-ERR syntax error\r\n", true},
+		{[]string{"SCAN", "0", "MATCH", "/h*"}, "*2\r\n$1\r\n0\r\n*1\r\n$5\r\n/home\r\n", true},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'\r\n", true},
+		{[]string{"QUIT"}, "+OK\r\n", false},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		more := hcs.respCommand(&out, "127.0.0.1", tt.args)
+		if out.String() != tt.reply || more != tt.more {
+			t.Errorf("%v: %q %v, want %q %v", tt.args, out.String(), more, tt.reply, tt.more)
+		}
+	}
+}
+
+func TestRedisGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*", "/a/b", true},
+		{"/blog/*", "/blog/2026/post", true},
+		{"/blog/*", "/blogroll", false},
+		{"/p?ge", "/page", true},
+		{"/p?ge", "/pge", false},
+		{"/[ab]", "/b", true},
+		{"/[ab]", "/c", false},
+		{`/a\*`, "/a*", true},
+		{`/a\*`, "/ab", false},
+		{"/a.b", "/axb", false},
+		{"/a+", "/a+", true},
+	}
+	for _, tt := range tests {
+		re, err := redisGlob(tt.pattern)
+		if err != nil || re.MatchString(tt.name) != tt.match {
+			t.Errorf("%s matches %s: %v %v, want %v", tt.pattern, tt.name, err == nil && re.MatchString(tt.name), err, tt.match)
+		}
+	}
+	if _, err := redisGlob("/[ab"); err == nil {
+		t.Error("an unclosed class is accepted")
+	}
+}
+
+// every step alone and the whole pipeline, which always runs in the same order
+func TestCanonicalizer(t *testing.T) {
+	all := strings.Join(canonicalSteps, ",")
+	tests := []struct {
+		steps string
+		in    string
+		want  string
+	}{
+		{"", "/Home/#top", "/Home/#top"},
+		{"fragment", "/a#b?c=d", "/a"},
+		{"decode", "/caf%C3%A9?q=%41", "/café?q=%41"},
+		{"decode", "/bad%zz", "/bad%zz"},
+		{"lowercase", "/Blog/Post?Ref=X", "/blog/post?Ref=X"},
+		{"trailing-slash", "/a//", "/a"},
+		{"trailing-slash", "/", "/"},
+		{"tracking-params", "/a?utm_source=x&b=2&a=1&fbclid=y", "/a?a=1&b=2"},
+		{"tracking-params", "/a?UTM_Medium=x", "/a"},
+		{"tracking-params", "/a/?utm_source=x", "/a/"},
+		{all, "/Caf%C3%A9/?b=2&utm_campaign=z&a=1#frag", "/café?a=1&b=2"},
+		{all, "/%2F/", "/"}, // decoded before the trailing slashes are stripped
+		{all, "#only", ""},
+	}
+	for _, tt := range tests {
+		cfg := testConfig()
+		cfg.Normalize = strings.Split(tt.steps, ",")
+		if got := newCanonicalizer(cfg).apply(tt.in); got != tt.want {
+			t.Errorf("%s with %q: %q, want %q", tt.in, tt.steps, got, tt.want)
+		}
+	}
+
+	cfg := testConfig()
+	cfg.Aliases = map[string]string{"/index.html": "/", "/home": "/"}
+	c := newCanonicalizer(cfg)
+	for in, want := range map[string]string{"/Index.html": "/", "/home/?utm_source=x": "/", "/homepage": "/homepage"} {
+		if got := c.apply(in); got != want {
+			t.Errorf("alias of %s: %q, want %q", in, got, want)
+		}
+	}
+	for in, want := range map[string]string{"/Blog/": "/blog/", "/A%2Fb": "/a/b", "/A?Q": "/a?Q"} {
+		if got := c.applyPrefix(in); got != want {
+			t.Errorf("prefix %s: %q, want %q", in, got, want)
+		}
+	}
+	if got := unknownSteps([]string{"decode", " lowercase ", "", "upper", "slash"}); fmt.Sprint(got) != "[upper slash]" {
+		t.Errorf("unknown steps %v", got)
+	}
+}
+
+func TestParseAlertRule(t *testing.T) {
+	tests := []struct {
+		args string
+		want string // String() of the rule, or the start of the error
+	}{
+		{"busy /home HITS 5m > 100", "busy /home HITS 5m0s > 100"},
+		{"quiet /checkout hits 1h < 1 for 10m", "quiet /checkout HITS 1h0m0s < 1 FOR 10m0s"},
+		{"fast /home RATE > 2.5", "fast /home RATE > 2.5"},
+		{"x /home", "usage:"},
+		{"x /home HITS 25h > 1", "invalid window 25h"},
+		{"x /home HITS 0s > 1", "invalid window 0s"},
+		{"x /home VISITS > 1", "unknown metric VISITS"},
+		{"x /home RATE >= 1", "invalid operator >="},
+		{"x /home RATE > -1", "invalid threshold -1"},
+		{"x /home RATE > 1 FOR", "expected <op> <n> [FOR <d>]"},
+		{"x /home RATE > 1 UNTIL 5m", "expected <op> <n> [FOR <d>]"},
+		{"x /home RATE > 1 FOR soon", "invalid duration soon"},
+	}
+	for _, tt := range tests {
+		r, err := parseAlertRule(strings.Fields(tt.args))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = r.String()
+		}
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// a rule fires once its condition held for FOR, resolves when it stops, and
+// each change is sent once
+func TestEvaluateAlerts(t *testing.T) {
+	cfg := testConfig()
+	cfg.AlertWebhook = "http://127.0.0.1:1/unused" // only the queue is used, runWebhook doesn't run
+	hcs := NewHitCounterServer(cfg)
+	conn := &clientConn{Conn: &recordConn{}}
+	hcs.alertCommand(conn, strings.Fields("ADD busy /Home HITS 1h > 2 FOR 20s"))
+	hcs.alertCommand(conn, strings.Fields("ADD quiet /checkout HITS 1m < 1"))
+	for i := 0; i < 3; i++ {
+		hcs.recordHit(hitRequest{Page: "/home", Visitor: fmt.Sprint(i)})
+	}
+
+	start := time.Now()
+	steps := []struct {
+		at     time.Duration
+		before func()
+		want   []string
+	}{
+		{0, nil, []string{"quiet firing 0"}},
+		{10 * time.Second, nil, nil},
+		{20 * time.Second, nil, []string{"busy firing 3"}},
+		{30 * time.Second, func() { hcs.recordHit(hitRequest{Page: "/checkout"}) }, []string{"quiet resolved 1"}},
+		{40 * time.Second, func() { hcs.runAdmin([]string{"RESET", "/home"}) }, []string{"busy resolved 0"}},
+		{50 * time.Second, func() { hcs.recordHit(hitRequest{Page: "/home", Count: 5, Aggregate: true}) }, nil},
+	}
+	for i, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		hcs.evaluateAlerts(start.Add(step.at))
+		var got []string
+		for len(hcs.alerts.webhook) > 0 {
+			e := <-hcs.alerts.webhook
+			got = append(got, fmt.Sprintf("%s %s %g", e.Alert, e.Status, e.Value))
+		}
+		sort.Strings(got)
+		if strings.Join(got, "|") != strings.Join(step.want, "|") {
+			t.Errorf("step %d: events %v, want %v", i, got, step.want)
+		}
+	}
+
+	rec := &recordConn{}
+	hcs.alertCommand(&clientConn{Conn: rec}, []string{"LIST"})
+	if got := rec.out.String(); !strings.Contains(got, "Alert busy /home HITS 1h0m0s > 2 FOR 20s ok\n") || !strings.Contains(got, "Alert quiet /checkout HITS 1m0s < 1 ok\n") {
+		t.Errorf("LIST:\n%s", got)
+	}
+}
+
+func TestParseStatsD(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // page, count and tags of every hit
+		err  bool
+	}{
+		{"", "", false},
+		{"/home:1|c", "/home 1 map[]", false},
+		{"  /home:5|c\r", "/home 5 map[]", false},
+		{"/home:1|c|@0.1", "/home 10 map[]", false},
+		{"/home:1|c|@0.3", "/home 3 map[]", false},
+		{"/home:1|c:2|c", "/home 1 map[]|/home 2 map[]", false},
+		{"/home:1|c|#ref:google.com,Country:et", "/home 1 map[country:et ref:google.com]", false},
+		{"/home:3|c|@0.5|#ref:a:b", "/home 6 map[ref:a:b]", false},
+		{"/home:0|c", "", false},
+		{"/home:250|ms", "", false},
+		{"/home:1|g:2|c", "/home 2 map[]", false},
+		{"/home", "", true},
+		{":1|c", "", true},
+		{"/home:1", "", true},
+		{"/home:x|c", "", true},
+		{"/home:-1|c", "", true},
+		{"/home:NaN|c", "", true},
+		{"/home:Inf|c", "", true},
+		{"/home:1|c|@0", "", true},
+		{"/home:1|c|@2", "", true},
+		{"/home:1|c|#ref", "", true},
+		{"/home:1|c|x", "", true},
+	}
+	for _, tt := range tests {
+		hits, err := parseStatsD(tt.line)
+		var got []string
+		for _, h := range hits {
+			if !h.Aggregate {
+				t.Errorf("%q: hit not marked as aggregate", tt.line)
+			}
+			got = append(got, fmt.Sprintf("%s %d %v", h.Page, h.Count, h.Tags))
+		}
+		if (err != nil) != tt.err || strings.Join(got, "|") != tt.want {
+			t.Errorf("%q: %q %v, want %q (error %v)", tt.line, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// what EXPORT writes IMPORT reads back, in both formats, evicted pages included
+func TestExportImportRoundTrip(t *testing.T) {
+	cfg := testConfig()
+	cfg.SpillDir = t.TempDir()
+	src := NewHitCounterServer(cfg)
+	spill, err := openSpillStore(cfg.SpillDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.pages.spill = spill
+	want := map[string]importRow{
+		"/home":           {Page: "/home", Hits: 7, Filtered: 2},
+		`/a,b "quoted"`:   {Page: `/a,b "quoted"`, Hits: 1},
+		"/search?q=x&y=ü": {Page: "/search?q=x&y=ü", Hits: 3},
+		"/cold":           {Page: "/cold", Hits: 4},
+	}
+	for name, row := range want {
+		page := src.updatePage(name, func(page *PageHit) { page.record(row.Hits, "v", nil) })
+		page.filtered.Store(row.Filtered)
+	}
+	cold, _ := src.pages.peek("/cold")
+	if !src.pages.evict(cold) {
+		t.Fatal("/cold was not evicted")
+	}
+
+	for _, format := range []string{"json", "csv"} {
+		var out strings.Builder
+		if n, err := src.writeExport(&out, format); err != nil || n != len(want) {
+			t.Fatalf("%s export: %d rows %v", format, n, err)
+		}
+		rows, err := readImport(bufio.NewReader(strings.NewReader(out.String()+"\n")), true, 0, nil)
+		if err != nil {
+			t.Fatalf("%s import: %v\n%s", format, err, out.String())
+		}
+
+		dst := NewHitCounterServer(Config{EvictPolicy: "lru"}) // names as sent
+		dst.recordHit(hitRequest{Page: "/stale"})
+		dst.importPages(rows, "replace")
+		if n := dst.pages.count(); n != len(want) {
+			t.Errorf("%s: %d pages after replace, want %d", format, n, len(want))
+		}
+		for name, row := range want {
+			page, ok := dst.lookupPage(name)
+			if !ok || page.total() != row.Hits || page.filtered.Load() != row.Filtered {
+				t.Errorf("%s: %s imported as %v, want %+v", format, name, page, row)
+			}
+		}
+	}
+}
+
+func TestReadImport(t *testing.T) {
+	tests := []struct {
+		in      string
+		needEnd bool
+		rows    string
+		err     string
+	}{
+		{"page,hits\n/a,1\n\n", true, "[{/a 1 0}]", ""},
+		{"/a,1,0,0,0,0,5\n/b,2\n\n", true, "[{/a 1 5} {/b 2 0}]", ""},
+		{`{"page":"/a","hits":3}` + "\n\n", true, "[{/a 3 0}]", ""},
+		{"/a,1\n", true, "[]", "the rows didn't end with an empty line"},
+		{"/a,1", false, "[{/a 1 0}]", ""},
+		{"/a,x\n/b,1\n\n", true, "[]", "line 1: invalid hits x"},
+		{"/a\n\n", true, "[]", "line 1: expected page,hits"},
+		{`{"hits":3}` + "\n\n", true, "[]", "line 1: missing page"},
+		{"/a,1\n/b,1\n/c,1\n\n", true, "[]", "more than 2 rows"},
+	}
+	for _, tt := range tests {
+		rows, err := readImport(bufio.NewReader(strings.NewReader(tt.in)), tt.needEnd, 2, nil)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err || (err == nil && fmt.Sprint(rows) != tt.rows) {
+			t.Errorf("%q: %v %q, want %s %q", tt.in, rows, got, tt.rows, tt.err)
+		}
+	}
+}